@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 
@@ -139,6 +140,45 @@ func readConfig(log *log.Logger, useconf bool, useconffile string, normaliseconf
 	return cfg
 }
 
+// Writes the configuration back to the file that it was read from. This is used
+// with -persistpeers to save peers that were added or removed at runtime. The
+// file is replaced atomically, so that a failed write can't lose the config.
+func writeConfig(cfg *config.NodeConfig, useconffile string, isjson bool) error {
+	cfg.RLock()
+	var bs []byte
+	var err error
+	if isjson {
+		bs, err = json.MarshalIndent(cfg, "", "  ")
+	} else {
+		bs, err = hjson.Marshal(cfg)
+	}
+	cfg.RUnlock()
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(useconffile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(useconffile), filepath.Base(useconffile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(bs, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), useconffile)
+}
+
 // Generates a new configuration and returns it in HJSON format. This is used
 // with -genconf.
 func doGenconf(isjson bool) string {
@@ -191,6 +231,7 @@ type yggArgs struct {
 	ver           bool
 	getaddr       bool
 	getsnet       bool
+	persistpeers  bool
 	useconffile   string
 	logto         string
 	loglevel      string
@@ -208,6 +249,7 @@ func getArgs() yggArgs {
 	getaddr := flag.Bool("address", false, "returns the IPv6 address as derived from the supplied configuration")
 	getsnet := flag.Bool("subnet", false, "returns the IPv6 subnet as derived from the supplied configuration")
 	loglevel := flag.String("loglevel", "info", "loglevel to enable")
+	persistpeers := flag.Bool("persistpeers", false, "use in combination with -useconffile, saves peers added or removed through the admin socket back to the file")
 	flag.Parse()
 	return yggArgs{
 		genconf:       *genconf,
@@ -221,6 +263,7 @@ func getArgs() yggArgs {
 		getaddr:       *getaddr,
 		getsnet:       *getsnet,
 		loglevel:      *loglevel,
+		persistpeers:  *persistpeers,
 	}
 }
 
@@ -346,6 +389,11 @@ func run(args yggArgs, ctx context.Context, done chan struct{}) {
 		logger.Errorln("An error occurred starting admin socket:", err)
 	}
 	n.admin.SetupAdminHandlers(n.admin)
+	if args.persistpeers && args.useconffile != "" {
+		n.admin.SetPersistConfig(func() error {
+			return writeConfig(cfg, args.useconffile, args.confjson)
+		})
+	}
 	// Start the multicast interface
 	if err := n.multicast.Init(&n.core, cfg, logger, nil); err != nil {
 		logger.Errorln("An error occurred initialising multicast:", err)
@@ -107,6 +107,8 @@ func run() int {
 		if recv["status"] == "error" {
 			if err, ok := recv["error"]; ok {
 				fmt.Println("Admin socket returned an error:", err)
+			} else if res, ok := recv["response"].(map[string]interface{}); ok && res["error"] != nil {
+				fmt.Println("Admin socket returned an error:", res["error"])
 			} else {
 				fmt.Println("Admin socket returned an error but didn't specify any error text")
 			}
@@ -177,7 +179,7 @@ func handleAll(recv map[string]interface{}, verbose bool) {
 	switch strings.ToLower(req["request"].(string)) {
 	case "dot":
 		handleDot(res)
-	case "list", "getpeers", "getswitchpeers", "getdht", "getsessions", "dhtping":
+	case "list", "getpeers", "getpeerstatus", "getdroppedconnections", "getswitchpeers", "getdht", "getsessions", "dhtping":
 		handleVariousInfo(res, verbose)
 	case "gettuntap", "settuntap":
 		handleGetAndSetTunTap(res)
@@ -191,6 +193,8 @@ func handleAll(recv map[string]interface{}, verbose bool) {
 		handleGetAllowedEncryptionPublicKeys(res)
 	case "getmulticastinterfaces":
 		handleGetMulticastInterfaces(res)
+	case "getevents":
+		handleGetEvents(res)
 	case "getsourcesubnets":
 		handleGetSourceSubnets(res)
 	case "getroutes":
@@ -256,8 +260,39 @@ func handleVariousInfo(res map[string]interface{}, verbose bool) {
 				preformatted := slv.(map[string]interface{})[k]
 				var formatted string
 				switch k {
-				case "bytes_sent", "bytes_recvd":
+				case "rtt_ms", "jitter_ms", "loss":
+					switch {
+					case preformatted == nil:
+						formatted = "-"
+					case k == "loss":
+						formatted = fmt.Sprintf("%.1f%%", preformatted.(float64)*100)
+					default:
+						formatted = fmt.Sprintf("%.2f", preformatted.(float64))
+					}
+				case "bytes_sent", "bytes_recvd", "count":
 					formatted = fmt.Sprintf("%d", uint(preformatted.(float64)))
+				case "rate_sent", "rate_recvd":
+					formatted = formatRate(preformatted.(float64))
+				case "max_rate_sent", "max_rate_recvd":
+					if preformatted.(float64) == 0 {
+						formatted = "-"
+					} else {
+						formatted = formatRate(preformatted.(float64))
+					}
+				case "name":
+					if formatted = fmt.Sprint(preformatted); formatted == "" {
+						formatted = "-"
+					}
+				case "tags":
+					var tags []string
+					if list, ok := preformatted.([]interface{}); ok {
+						for _, tag := range list {
+							tags = append(tags, fmt.Sprint(tag))
+						}
+					}
+					if formatted = strings.Join(tags, ","); formatted == "" {
+						formatted = "-"
+					}
 				case "uptime", "last_seen":
 					seconds := uint(preformatted.(float64)) % 60
 					minutes := uint(preformatted.(float64)/60) % 60
@@ -273,6 +308,20 @@ func handleVariousInfo(res map[string]interface{}, verbose bool) {
 	}
 }
 
+// Formats a rate in bytes per second, e.g. "1.5MB/s".
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1e9:
+		return fmt.Sprintf("%.1fGB/s", rate/1e9)
+	case rate >= 1e6:
+		return fmt.Sprintf("%.1fMB/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.1fkB/s", rate/1e3)
+	default:
+		return fmt.Sprintf("%dB/s", uint(rate))
+	}
+}
+
 func handleGetAndSetTunTap(res map[string]interface{}) {
 	for k, v := range res {
 		fmt.Println("Interface name:", k)
@@ -303,6 +352,9 @@ func handleGetSelf(res map[string]interface{}, verbose bool) {
 		if coords, ok := v.(map[string]interface{})["coords"].(string); ok {
 			fmt.Println("Coords:", coords)
 		}
+		if expiry, ok := v.(map[string]interface{})["certificate_expiry"].(string); ok {
+			fmt.Println("TLS certificate expiry:", expiry)
+		}
 		if verbose {
 			if nodeID, ok := v.(map[string]interface{})["node_id"].(string); ok {
 				fmt.Println("Node ID:", nodeID)
@@ -403,6 +455,26 @@ func handleGetAllowedEncryptionPublicKeys(res map[string]interface{}) {
 	}
 }
 
+func handleGetEvents(res map[string]interface{}) {
+	events, _ := res["events"].([]interface{})
+	if len(events) == 0 {
+		fmt.Println("No events found")
+	}
+	for _, e := range events {
+		event := e.(map[string]interface{})
+		line := fmt.Sprintf("%d %s %s", uint64(event["seq"].(float64)), event["time"], event["type"])
+		for _, k := range []string{"link_type", "local", "remote", "key", "error"} {
+			if v, ok := event[k]; ok && v != "" {
+				line += fmt.Sprintf(" %s=%v", k, v)
+			}
+		}
+		fmt.Println(line)
+	}
+	if last, ok := res["last"].(float64); ok {
+		fmt.Println("Last event:", uint64(last))
+	}
+}
+
 func handleGetMulticastInterfaces(res map[string]interface{}) {
 	if _, ok := res["multicast_interfaces"]; !ok {
 		fmt.Println("No multicast interfaces found")
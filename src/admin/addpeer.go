@@ -0,0 +1,18 @@
+package admin
+
+type AddPeerRequest struct {
+	Uri   string `json:"uri"`
+	Sintf string `json:"interface,omitempty"`
+}
+
+type AddPeerResponse struct {
+	Added []string `json:"added"`
+}
+
+func (a *AdminSocket) addPeerHandler(req *AddPeerRequest, res *AddPeerResponse) error {
+	if err := a.core.AddPeer(req.Uri, req.Sintf); err != nil {
+		return err
+	}
+	res.Added = []string{req.Uri}
+	return a.persistConfig()
+}
@@ -26,6 +26,9 @@ type AdminSocket struct {
 	listener   net.Listener
 	handlers   map[string]handler
 	done       chan struct{}
+	persist    func() error
+	events     eventHistory
+	stopEvents func()
 }
 
 type AdminSocketResponse struct {
@@ -83,9 +86,29 @@ func (a *AdminSocket) Init(c *core.Core, nc *config.NodeConfig, log *log.Logger,
 		}
 		return res, nil
 	})
+	var events <-chan core.Event
+	events, a.stopEvents = c.SubscribeEvents()
+	go a.events.run(events)
 	return a.core.SetAdmin(a)
 }
 
+// SetPersistConfig sets a function that is called whenever the configuration
+// has been changed through the admin socket, e.g. by adding or removing peers,
+// so that the changes can be saved and survive a restart.
+func (a *AdminSocket) SetPersistConfig(persist func() error) {
+	a.persist = persist
+}
+
+func (a *AdminSocket) persistConfig() error {
+	if a.persist == nil {
+		return nil
+	}
+	if err := a.persist(); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	return nil
+}
+
 func (a *AdminSocket) SetupAdminHandlers(na *AdminSocket) {
 	_ = a.AddHandler("getSelf", []string{}, func(in json.RawMessage) (interface{}, error) {
 		req := &GetSelfRequest{}
@@ -98,7 +121,7 @@ func (a *AdminSocket) SetupAdminHandlers(na *AdminSocket) {
 		}
 		return res, nil
 	})
-	_ = a.AddHandler("getPeers", []string{}, func(in json.RawMessage) (interface{}, error) {
+	_ = a.AddHandler("getPeers", []string{"[name]", "[tags]"}, func(in json.RawMessage) (interface{}, error) {
 		req := &GetPeersRequest{}
 		res := &GetPeersResponse{}
 		if err := json.Unmarshal(in, &req); err != nil {
@@ -109,6 +132,39 @@ func (a *AdminSocket) SetupAdminHandlers(na *AdminSocket) {
 		}
 		return res, nil
 	})
+	_ = a.AddHandler("getPeerStatus", []string{}, func(in json.RawMessage) (interface{}, error) {
+		req := &GetPeerStatusRequest{}
+		res := &GetPeerStatusResponse{}
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		if err := a.getPeerStatusHandler(req, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+	_ = a.AddHandler("getDroppedConnections", []string{}, func(in json.RawMessage) (interface{}, error) {
+		req := &GetDroppedConnectionsRequest{}
+		res := &GetDroppedConnectionsResponse{}
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		if err := a.getDroppedConnectionsHandler(req, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+	_ = a.AddHandler("getEvents", []string{"[since]", "[wait]"}, func(in json.RawMessage) (interface{}, error) {
+		req := &GetEventsRequest{}
+		res := &GetEventsResponse{}
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		if err := a.getEventsHandler(req, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
 	_ = a.AddHandler("getDHT", []string{}, func(in json.RawMessage) (interface{}, error) {
 		req := &GetDHTRequest{}
 		res := &GetDHTResponse{}
@@ -142,6 +198,28 @@ func (a *AdminSocket) SetupAdminHandlers(na *AdminSocket) {
 		}
 		return res, nil
 	})
+	_ = a.AddHandler("addPeer", []string{"uri", "[interface]"}, func(in json.RawMessage) (interface{}, error) {
+		req := &AddPeerRequest{}
+		res := &AddPeerResponse{}
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		if err := a.addPeerHandler(req, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+	_ = a.AddHandler("removePeer", []string{"uri", "[interface]"}, func(in json.RawMessage) (interface{}, error) {
+		req := &RemovePeerRequest{}
+		res := &RemovePeerResponse{}
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		if err := a.removePeerHandler(req, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
 	//_ = a.AddHandler("getNodeInfo", []string{"key"}, t.proto.nodeinfo.nodeInfoAdminHandler)
 	//_ = a.AddHandler("debug_remoteGetSelf", []string{"key"}, t.proto.getSelfHandler)
 	//_ = a.AddHandler("debug_remoteGetPeers", []string{"key"}, t.proto.getPeersHandler)
@@ -171,6 +249,9 @@ func (a *AdminSocket) IsStarted() bool {
 
 // Stop will stop the admin API and close the socket.
 func (a *AdminSocket) Stop() error {
+	if a.stopEvents != nil {
+		a.stopEvents()
+	}
 	if a.listener != nil {
 		select {
 		case <-a.done:
@@ -0,0 +1,22 @@
+package admin
+
+type GetDroppedConnectionsRequest struct{}
+
+type GetDroppedConnectionsResponse struct {
+	Dropped map[string]DroppedConnectionsEntry `json:"dropped"`
+}
+
+type DroppedConnectionsEntry struct {
+	Count uint64 `json:"count"`
+}
+
+func (a *AdminSocket) getDroppedConnectionsHandler(req *GetDroppedConnectionsRequest, res *GetDroppedConnectionsResponse) error {
+	dropped := a.core.GetDroppedConnections()
+	res.Dropped = map[string]DroppedConnectionsEntry{
+		"source_not_allowed":  {Count: dropped.SourceNotAllowed},
+		"source_rate_limited": {Count: dropped.SourceRateLimited},
+		"too_many_handshakes": {Count: dropped.TooManyHandshakes},
+		"handshake_timeout":   {Count: dropped.HandshakeTimeout},
+	}
+	return nil
+}
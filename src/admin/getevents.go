@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// How many events are kept for getEvents, and the longest that it will wait
+// for a new one.
+const (
+	eventHistorySize = 256
+	eventMaxWait     = 60 * time.Second
+)
+
+type GetEventsRequest struct {
+	Since uint64 `json:"since"` // Only return events after this one
+	Wait  uint64 `json:"wait"`  // How many seconds to wait for an event if there are none yet
+}
+
+type GetEventsResponse struct {
+	Events []EventEntry `json:"events"`
+	Last   uint64       `json:"last"` // The number of the newest event, for the next request
+}
+
+type EventEntry struct {
+	Seq      uint64 `json:"seq"`
+	Type     string `json:"type"`
+	Time     string `json:"time"`
+	Key      string `json:"key,omitempty"`
+	LinkType string `json:"link_type"`
+	Local    string `json:"local,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Inbound  bool   `json:"inbound"`
+	Error    string `json:"error,omitempty"`
+}
+
+// eventHistory keeps the most recent events, so that clients of the admin
+// socket can poll for the ones that they haven't seen yet.
+type eventHistory struct {
+	mutex   sync.Mutex
+	events  []EventEntry  // Oldest first
+	last    uint64        // The number of the newest event
+	updated chan struct{} // Closed when a new event arrives
+}
+
+// Keeps events from the core until it stops sending them.
+func (h *eventHistory) run(events <-chan core.Event) {
+	for event := range events {
+		entry := EventEntry{
+			Type:     string(event.Type),
+			Time:     event.Time.Format(time.RFC3339Nano),
+			LinkType: event.LinkType,
+			Local:    event.Local,
+			Remote:   event.Remote,
+			Inbound:  event.Inbound,
+		}
+		if event.Key != nil {
+			entry.Key = hex.EncodeToString(event.Key)
+		}
+		if event.Err != nil {
+			entry.Error = event.Err.Error()
+		}
+		h.mutex.Lock()
+		h.last++
+		entry.Seq = h.last
+		h.events = append(h.events, entry)
+		if len(h.events) > eventHistorySize {
+			h.events = h.events[len(h.events)-eventHistorySize:]
+		}
+		if h.updated != nil {
+			close(h.updated)
+			h.updated = nil
+		}
+		h.mutex.Unlock()
+	}
+}
+
+// Gets the events after the given one, and a channel that is closed when there
+// is another.
+func (h *eventHistory) since(seq uint64) ([]EventEntry, uint64, <-chan struct{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var events []EventEntry
+	for _, entry := range h.events {
+		if entry.Seq > seq {
+			events = append(events, entry)
+		}
+	}
+	if h.updated == nil {
+		h.updated = make(chan struct{})
+	}
+	return events, h.last, h.updated
+}
+
+func (a *AdminSocket) getEventsHandler(req *GetEventsRequest, res *GetEventsResponse) error {
+	var updated <-chan struct{}
+	res.Events, res.Last, updated = a.events.since(req.Since)
+	if len(res.Events) == 0 && req.Wait > 0 {
+		wait := time.Duration(req.Wait) * time.Second
+		if wait > eventMaxWait {
+			wait = eventMaxWait
+		}
+		select {
+		case <-updated:
+			res.Events, res.Last, _ = a.events.since(req.Since)
+		case <-time.After(wait):
+		}
+	}
+	if res.Events == nil {
+		res.Events = []EventEntry{}
+	}
+	return nil
+}
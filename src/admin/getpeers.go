@@ -2,12 +2,22 @@ package admin
 
 import (
 	"encoding/hex"
+	"fmt"
 	"net"
+	"path"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 )
 
+// GetPeersRequest can narrow the peers down to those whose name matches a
+// pattern, e.g. "backbone-*", and those that have all of a comma-separated list
+// of tags.
 type GetPeersRequest struct {
+	Name string `json:"name"`
+	Tags string `json:"tags"`
 }
 
 type GetPeersResponse struct {
@@ -19,25 +29,63 @@ type PeerEntry struct {
 	Port      uint64   `json:"port"`
 	Coords    []uint64 `json:"coords"`
 	Remote    string   `json:"remote"`
+	Address   string   `json:"address"` // The address that was dialed, for outgoing links
+	Name      string   `json:"name"`
+	Tags      []string `json:"tags"`
 	RXBytes   uint64   `json:"bytes_recvd"`
 	TXBytes   uint64   `json:"bytes_sent"`
+	RXRate    uint64   `json:"rate_recvd"`
+	TXRate    uint64   `json:"rate_sent"`
+	MaxRXRate uint64   `json:"max_rate_recvd"`
+	MaxTXRate uint64   `json:"max_rate_sent"`
 	Uptime    float64  `json:"uptime"`
+	RTT       *float64 `json:"rtt_ms"` // These are null until the link has been pinged
+	Jitter    *float64 `json:"jitter_ms"`
+	Loss      *float64 `json:"loss"`
 }
 
 func (a *AdminSocket) getPeersHandler(req *GetPeersRequest, res *GetPeersResponse) error {
+	if _, err := path.Match(req.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q", req.Name)
+	}
+	var tags []string
+	for _, tag := range strings.Split(req.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
 	res.Peers = map[string]PeerEntry{}
 	for _, p := range a.core.GetPeers() {
+		if matched, _ := path.Match(req.Name, p.Name); req.Name != "" && !matched {
+			continue
+		}
+		if slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(p.Tags, tag) }) {
+			continue
+		}
 		addr := address.AddrForKey(p.Key)
 		so := net.IP(addr[:]).String()
-		res.Peers[so] = PeerEntry{
+		entry := PeerEntry{
 			PublicKey: hex.EncodeToString(p.Key),
 			Port:      p.Port,
 			Coords:    p.Coords,
 			Remote:    p.Remote,
+			Address:   p.Address,
+			Name:      p.Name,
+			Tags:      p.Tags,
 			RXBytes:   p.RXBytes,
 			TXBytes:   p.TXBytes,
+			RXRate:    p.RXRate,
+			TXRate:    p.TXRate,
+			MaxRXRate: p.MaxRXRate,
+			MaxTXRate: p.MaxTXRate,
 			Uptime:    p.Uptime.Seconds(),
 		}
+		if p.Measured {
+			rtt := float64(p.RTT) / float64(time.Millisecond)
+			jitter := float64(p.Jitter) / float64(time.Millisecond)
+			entry.RTT, entry.Jitter, entry.Loss = &rtt, &jitter, &p.Loss
+		}
+		res.Peers[so] = entry
 	}
 	return nil
 }
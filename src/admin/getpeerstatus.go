@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"time"
+)
+
+type GetPeerStatusRequest struct {
+}
+
+type GetPeerStatusResponse struct {
+	Peers map[string]PeerStatusEntry `json:"peers"`
+}
+
+type PeerStatusEntry struct {
+	Interface   string `json:"interface"`
+	State       string `json:"state"`
+	LastError   string `json:"last_error"`
+	NextAttempt string `json:"next_attempt"`
+}
+
+func (a *AdminSocket) getPeerStatusHandler(req *GetPeerStatusRequest, res *GetPeerStatusResponse) error {
+	res.Peers = map[string]PeerStatusEntry{}
+	for _, p := range a.core.GetPeerStatus() {
+		entry := PeerStatusEntry{
+			Interface: p.Interface,
+			State:     p.State,
+		}
+		if p.LastError != nil {
+			entry.LastError = p.LastError.Error()
+		}
+		if !p.NextAttempt.IsZero() {
+			entry.NextAttempt = p.NextAttempt.Format(time.RFC3339)
+		}
+		name := p.URI
+		if p.Interface != "" {
+			name += " (" + p.Interface + ")"
+		}
+		res.Peers[name] = entry
+	}
+	return nil
+}
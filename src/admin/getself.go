@@ -2,6 +2,7 @@ package admin
 
 import (
 	"encoding/hex"
+	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/version"
 )
@@ -18,6 +19,7 @@ type SelfEntry struct {
 	PublicKey    string   `json:"key"`
 	Coords       []uint64 `json:"coords"`
 	Subnet       string   `json:"subnet"`
+	CertExpiry   string   `json:"certificate_expiry"`
 }
 
 func (a *AdminSocket) getSelfHandler(req *GetSelfRequest, res *GetSelfResponse) error {
@@ -31,6 +33,7 @@ func (a *AdminSocket) getSelfHandler(req *GetSelfRequest, res *GetSelfResponse)
 		PublicKey:    hex.EncodeToString(self.Key[:]),
 		Subnet:       snet.String(),
 		Coords:       self.Coords,
+		CertExpiry:   self.CertificateExpiry.Format(time.RFC3339),
 	}
 	return nil
 }
@@ -0,0 +1,18 @@
+package admin
+
+type RemovePeerRequest struct {
+	Uri   string `json:"uri"`
+	Sintf string `json:"interface,omitempty"`
+}
+
+type RemovePeerResponse struct {
+	Removed []string `json:"removed"`
+}
+
+func (a *AdminSocket) removePeerHandler(req *RemovePeerRequest, res *RemovePeerResponse) error {
+	if err := a.core.RemovePeer(req.Uri, req.Sintf); err != nil {
+		return err
+	}
+	res.Removed = []string{req.Uri}
+	return a.persistConfig()
+}
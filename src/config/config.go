@@ -26,19 +26,30 @@ import (
 // options that are necessary for an Yggdrasil node to run. You will need to
 // supply one of these structs to the Yggdrasil core when starting a node.
 type NodeConfig struct {
-	sync.RWMutex        `json:"-"`
-	Peers               []string                   `comment:"List of connection strings for outbound peer connections in URI format,\ne.g. tls://a.b.c.d:e or socks://a.b.c.d:e/f.g.h.i:j. These connections\nwill obey the operating system routing table, therefore you should\nuse this section when you may connect via different interfaces."`
-	InterfacePeers      map[string][]string        `comment:"List of connection strings for outbound peer connections in URI format,\narranged by source interface, e.g. { \"eth0\": [ tls://a.b.c.d:e ] }.\nNote that SOCKS peerings will NOT be affected by this option and should\ngo in the \"Peers\" section instead."`
-	Listen              []string                   `comment:"Listen addresses for incoming connections. You will need to add\nlisteners in order to accept incoming peerings from non-local nodes.\nMulticast peer discovery will work regardless of any listeners set\nhere. Each listener should be specified in URI format as above, e.g.\ntls://0.0.0.0:0 or tls://[::]:0 to listen on all interfaces."`
-	AdminListen         string                     `comment:"Listen address for admin connections. Default is to listen for local\nconnections either on TCP/9001 or a UNIX socket depending on your\nplatform. Use this value for yggdrasilctl -endpoint=X. To disable\nthe admin socket, use the value \"none\" instead."`
-	MulticastInterfaces []MulticastInterfaceConfig `comment:"Configuration for which interfaces multicast peer discovery should be\nenabled on. Each entry in the list should be a json object which may\ncontain Regex, Beacon, Listen, and Port. Regex is a regular expression\nwhich is matched against an interface name, and interfaces use the\nfirst configuration that they match gainst. Beacon configures whether\nor not the node should send link-local multicast beacons to advertise\ntheir presence, while listening for incoming connections on Port.\nListen controls whether or not the node listens for multicast beacons\nand opens outgoing connections."`
-	AllowedPublicKeys   []string                   `comment:"List of peer public keys to allow incoming peering connections\nfrom. If left empty/undefined then all connections will be allowed\nby default. This does not affect outgoing peerings, nor does it\naffect link-local peers discovered via multicast."`
-	PublicKey           string                     `comment:"Your public key. Your peers may ask you for this to put\ninto their AllowedPublicKeys configuration."`
-	PrivateKey          string                     `comment:"Your private key. DO NOT share this with anyone!"`
-	IfName              string                     `comment:"Local network interface name for TUN adapter, or \"auto\" to select\nan interface automatically, or \"none\" to run without TUN."`
-	IfMTU               uint64                     `comment:"Maximum Transmission Unit (MTU) size for your local TUN interface.\nDefault is the largest supported size for your platform. The lowest\npossible value is 1280."`
-	NodeInfoPrivacy     bool                       `comment:"By default, nodeinfo contains some defaults including the platform,\narchitecture and Yggdrasil version. These can help when surveying\nthe network and diagnosing network routing problems. Enabling\nnodeinfo privacy prevents this, so that only items specified in\n\"NodeInfo\" are sent back if specified."`
-	NodeInfo            map[string]interface{}     `comment:"Optional node info. This must be a { \"key\": \"value\", ... } map\nor set as null. This is entirely optional but, if set, is visible\nto the whole network on request."`
+	sync.RWMutex               `json:"-"`
+	Peers                      []string                   `comment:"List of connection strings for outbound peer connections in URI format,\ne.g. tls://a.b.c.d:e, quic://a.b.c.d:e, socks://a.b.c.d:e/f.g.h.i:j\nor http-proxy://a.b.c.d:e/f.g.h.i:j. A srv://_yggdrasil._tcp.example.org\npeer is expanded into the targets of the SRV records for that name,\ncalled with ?scheme= (default tls), ?count= of them at a time (default 2)\nand with keys pinned from TXT records of the form \"key=<hex>\".\nA tcp://, tls:// or obfs:// peer can be called from a given source\naddress and port by adding ?source=, e.g. ?source=[2001:db8::1]:4000,\n?source=192.0.2.1 or ?source=:4000.\nPeers and listeners can be given a name and tags to show in getPeers\nand the logs by adding e.g. ?name=backbone-1&tags=transit,eu.\nThese connections will obey the operating system routing table,\ntherefore you should use this section when you may connect via\ndifferent interfaces."`
+	InterfacePeers             map[string][]string        `comment:"List of connection strings for outbound peer connections in URI format,\narranged by source interface, e.g. { \"eth0\": [ tls://a.b.c.d:e ] }.\nNote that SOCKS peerings will NOT be affected by this option and should\ngo in the \"Peers\" section instead."`
+	PeersFile                  string                     `comment:"Path to a file of further peers, one URI per line, each optionally\nfollowed by the interface to call it on. Blank lines and lines starting\nwith # are ignored. The file is checked for changes every few seconds,\nand peers that are added or removed are called or disconnected without\ntouching the links to the others."`
+	Listen                     []string                   `comment:"Listen addresses for incoming connections. You will need to add\nlisteners in order to accept incoming peerings from non-local nodes.\nMulticast peer discovery will work regardless of any listeners set\nhere. Each listener should be specified in URI format as above, e.g.\ntls://0.0.0.0:0 or tls://[::]:0 to listen on all interfaces. A tls://\nlistener can present a certificate from a CA, for peers that dial it\nwith ?verify=system, by adding ?cert=/path/to/cert.pem&key=/path/to/key.pem.\nA tcp:// or tls:// listener behind a load balancer can take the real\naddress of each peer from a PROXY protocol header by adding\n?proxyprotocol=1&proxysource= with the addresses of the load\nbalancers, in which case only they may connect and every connection\nmust have one. An obfs:// listener hides its links from observers, and\nmust be dialed with ?key= set to this node's public key. A ws://\nlistener takes WebSocket links on the path in its URI, e.g.\nws://[::]:8080/ygg. There are no wss:// listeners, so for peers that\ndial wss:// put a ws:// listener behind a reverse proxy that handles TLS."`
+	AdminListen                string                     `comment:"Listen address for admin connections. Default is to listen for local\nconnections either on TCP/9001 or a UNIX socket depending on your\nplatform. Use this value for yggdrasilctl -endpoint=X. To disable\nthe admin socket, use the value \"none\" instead."`
+	MulticastInterfaces        []MulticastInterfaceConfig `comment:"Configuration for which interfaces multicast peer discovery should be\nenabled on. Each entry in the list should be a json object which may\ncontain Regex, Beacon, Listen, and Port. Regex is a regular expression\nwhich is matched against an interface name, and interfaces use the\nfirst configuration that they match gainst. Beacon configures whether\nor not the node should send link-local multicast beacons to advertise\ntheir presence, while listening for incoming connections on Port.\nListen controls whether or not the node listens for multicast beacons\nand opens outgoing connections."`
+	AllowedPublicKeys          []string                   `comment:"List of peer public keys to allow incoming peering connections\nfrom. If left empty/undefined then all connections will be allowed\nby default. This does not affect outgoing peerings, nor does it\naffect link-local peers discovered via multicast."`
+	RejectLegacyPeers          bool                       `comment:"Refuse links to and from nodes running version 0.4, which can't prove\nthat they own the public key that they send. These are accepted for\nnow, so that a network can be upgraded one node at a time, except\nwhere the key would be checked against AllowedPublicKeys or a ?key=\npinned in a peer URI. Default is false."`
+	AllowedListenSources       []string                   `comment:"List of addresses or prefixes, e.g. 192.0.2.0/24 or 2001:db8::/32, that\nincoming connections to any listener are accepted from. If left empty\nthen connections from anywhere are accepted, except those in\nDeniedListenSources. Sources can also be set for a single listener by\nadding ?allowsource= and ?denysource= to its URI. Connections are\nchecked before the TLS and link handshakes, unlike AllowedPublicKeys."`
+	DeniedListenSources        []string                   `comment:"List of addresses or prefixes that incoming connections to any\nlistener are never accepted from, even if they are also allowed."`
+	HandshakeTimeout           uint64                     `comment:"How long, in seconds, a new peering link has to finish its handshake,\nincluding TLS, before it is dropped. Default is 10."`
+	MaxPendingHandshakes       uint64                     `comment:"How many incoming peering connections can be doing their handshakes\nat once. Any more are dropped as soon as they are accepted, so that\nclients which never finish can't use up the node. Default is 64."`
+	SourceConnectionsPerMinute uint64                     `comment:"How many incoming peering connections are accepted from one address\nper minute, or from one /64 for IPv6. Up to this many are accepted at\nonce, after which they are accepted at this rate. Default is 30."`
+	KeepAliveInterval          uint64                     `comment:"How long, in seconds, a peering link can be idle before a keepalive is\nsent on it, so that the remote side knows that the link is still up.\nThe router already sends one after 4 seconds, so only a shorter\ninterval makes a difference. Default is 4."`
+	ReadTimeout                uint64                     `comment:"How long, in seconds, to wait to hear anything from a peer before\ndeciding that the link is dead, dropping it and, for configured peers,\ncalling them again. This should be longer than the keepalive interval\nof both sides. Peers that support it are told this, so that they send\nkeepalives often enough, but others only send them every 4 seconds,\nso links to those are given at least 6. Default is 6."`
+	MaxRXRate                  uint64                     `comment:"Limit on the total rate, in bytes per second, at which data is received\nfrom all peers together. Limits for individual peers or listeners can\nbe set with ?maxrate=, ?maxrxrate= and ?maxtxrate= in their URIs, e.g.\ntls://a.b.c.d:e?maxrate=500k. Default is 0, i.e. no limit."`
+	MaxTXRate                  uint64                     `comment:"Limit on the total rate, in bytes per second, at which data is sent to\nall peers together. Default is 0, i.e. no limit."`
+	PublicKey                  string                     `comment:"Your public key. Your peers may ask you for this to put\ninto their AllowedPublicKeys configuration."`
+	PrivateKey                 string                     `comment:"Your private key. DO NOT share this with anyone!"`
+	IfName                     string                     `comment:"Local network interface name for TUN adapter, or \"auto\" to select\nan interface automatically, or \"none\" to run without TUN."`
+	IfMTU                      uint64                     `comment:"Maximum Transmission Unit (MTU) size for your local TUN interface.\nDefault is the largest supported size for your platform. The lowest\npossible value is 1280."`
+	NodeInfoPrivacy            bool                       `comment:"By default, nodeinfo contains some defaults including the platform,\narchitecture and Yggdrasil version. These can help when surveying\nthe network and diagnosing network routing problems. Enabling\nnodeinfo privacy prevents this, so that only items specified in\n\"NodeInfo\" are sent back if specified."`
+	NodeInfo                   map[string]interface{}     `comment:"Optional node info. This must be a { \"key\": \"value\", ... } map\nor set as null. This is entirely optional but, if set, is visible\nto the whole network on request."`
 }
 
 type MulticastInterfaceConfig struct {
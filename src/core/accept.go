@@ -0,0 +1,197 @@
+package core
+
+// This protects listeners from floods of incoming connections. Connections are
+// dropped if they come from a source that isn't allowed, see sources.go, if
+// their source has opened too many recently, or if too many handshakes are
+// already in progress, and any that don't finish the handshake in time are
+// closed. The number of connections dropped for each reason is kept so that it
+// can be shown by the admin socket.
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The defaults for the flood protection options.
+const (
+	acceptHandshakeTimeoutDefault     = 10 * time.Second
+	acceptMaxPendingHandshakesDefault = 64
+	acceptSourceRateDefault           = 30 // Connections per minute
+)
+
+// How often to log dropped connections, so that a flood of them doesn't flood
+// the log too, and how often to forget the sources that haven't connected
+// recently.
+const (
+	acceptDropLogInterval = 10 * time.Second
+	acceptPruneInterval   = time.Minute
+)
+
+// IPv6 sources are rate limited by the /64 that they are in, since anyone with
+// one address will usually have all of the others in it too. Link-local sources
+// are the exception, since every neighbour on every interface is in fe80::/64,
+// so they are rate limited by their own address and interface instead.
+const acceptIPv6SourceBits = 64
+
+// acceptDrops counts the connections that have been dropped for each reason.
+type acceptDrops struct {
+	source     atomic.Uint64 // The source isn't allowed
+	rate       atomic.Uint64 // The source has opened too many connections recently
+	handshakes atomic.Uint64 // Too many handshakes were already in progress
+	timeout    atomic.Uint64 // The handshake didn't finish in time
+}
+
+// acceptGuard decides which incoming connections are accepted.
+type acceptGuard struct {
+	handshakes chan struct{} // Holds a token for each handshake in progress
+	sourceRate uint64        // How many connections a source may open per minute
+	drops      acceptDrops
+	mutex      sync.Mutex // Protects the below
+	limiters   map[netip.Addr]*rate.Limiter
+	pruned     time.Time
+	suppressed uint64 // Drops since the last time one was logged
+	lastLog    time.Time
+}
+
+func (a *acceptGuard) init(maxHandshakes, sourceRate uint64) {
+	if maxHandshakes == 0 {
+		maxHandshakes = acceptMaxPendingHandshakesDefault
+	}
+	if sourceRate == 0 {
+		sourceRate = acceptSourceRateDefault
+	}
+	a.handshakes = make(chan struct{}, maxHandshakes)
+	a.sourceRate = sourceRate
+	a.limiters = make(map[netip.Addr]*rate.Limiter)
+	a.pruned = time.Now()
+}
+
+// Checks whether the source of a new connection may open another one. A
+// source may open as many as sourceRate at once, and then gets another one
+// back every minute/sourceRate.
+func (a *acceptGuard) allowRate(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.Is6() && !addr.IsLinkLocalUnicast() {
+		addr = netip.PrefixFrom(addr.WithZone(""), acceptIPv6SourceBits).Masked().Addr()
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if time.Since(a.pruned) >= acceptPruneInterval {
+		// Sources with a full bucket would be allowed anyway, so forget them
+		for source, limiter := range a.limiters {
+			if limiter.Tokens() >= float64(limiter.Burst()) {
+				delete(a.limiters, source)
+			}
+		}
+		a.pruned = time.Now()
+	}
+	limiter, isIn := a.limiters[addr]
+	if !isIn {
+		limiter = rate.NewLimiter(rate.Limit(float64(a.sourceRate)/60), int(a.sourceRate))
+		a.limiters[addr] = limiter
+	}
+	return limiter.Allow()
+}
+
+// Starts a handshake if there is room for another one, in which case
+// finishHandshake must be called once it is over.
+func (a *acceptGuard) startHandshake() bool {
+	select {
+	case a.handshakes <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *acceptGuard) finishHandshake() {
+	<-a.handshakes
+}
+
+// Checks whether a new connection is accepted, given its source. Connections
+// that aren't over IP, e.g. UNIX sockets, aren't checked.
+func (t *tcp) admit(remote, local net.Addr, options *tcpOptions) bool {
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return true
+	}
+	switch {
+	case !t.sources.allows(addrPort.Addr()) || !options.sources.allows(addrPort.Addr()):
+		t.dropped(&t.accept.drops.source, remote, local, "source address not allowed")
+		return false
+	case !t.accept.allowRate(addrPort.Addr()):
+		t.dropped(&t.accept.drops.rate, remote, local, "too many connections from source address")
+		return false
+	}
+	return true
+}
+
+// Checks whether a new connection to a listener that reads PROXY protocol
+// headers is accepted, before the header is read. It must come from one of the
+// load balancers that the listener trusts to send them, and the load balancer
+// is rate limited like any other source, as well as the source in the header.
+func (t *tcp) admitProxy(remote, local net.Addr, options *tcpOptions) bool {
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap().WithZone("")
+	trusted := false
+	for _, prefix := range options.proxySources {
+		if prefix.Contains(addr) {
+			trusted = true
+			break
+		}
+	}
+	switch {
+	case !trusted:
+		t.dropped(&t.accept.drops.source, remote, local, "not a trusted PROXY protocol source")
+		return false
+	case !t.accept.allowRate(addr):
+		t.dropped(&t.accept.drops.rate, remote, local, "too many connections from load balancer")
+		return false
+	}
+	return true
+}
+
+// Counts a dropped connection and logs it, unless another one has been logged
+// too recently.
+func (t *tcp) dropped(counter *atomic.Uint64, remote, local net.Addr, reason string) {
+	counter.Add(1)
+	a := &t.accept
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if time.Since(a.lastLog) < acceptDropLogInterval {
+		a.suppressed++
+		return
+	}
+	if a.suppressed > 0 {
+		t.links.core.log.Infof("Dropped connection from %s on %s: %s (%d more dropped since last message)", remote, local, reason, a.suppressed)
+	} else {
+		t.links.core.log.Infof("Dropped connection from %s on %s: %s", remote, local, reason)
+	}
+	a.suppressed = 0
+	a.lastLog = time.Now()
+}
+
+// handshakeTimeoutError is returned by the link handshake when it doesn't
+// finish in time.
+type handshakeTimeoutError string
+
+func (e handshakeTimeoutError) Error() string {
+	return "timeout on " + string(e)
+}
+
+// Checks whether an error from the handshake, including the TLS handshake and
+// reading the PROXY protocol header, means that it didn't finish in time.
+func isHandshakeTimeout(err error) bool {
+	var timeout handshakeTimeoutError
+	return errors.As(err, &timeout) || errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -7,35 +7,72 @@ import (
 
 	//"encoding/hex"
 	"encoding/json"
-	//"errors"
-	//"fmt"
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"slices"
+	"sort"
+	"strings"
 
-	//"sort"
 	//"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/gologme/log"
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	//"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
-	//"github.com/Arceliar/phony"
 )
 
 type Self struct {
-	Key    ed25519.PublicKey
-	Root   ed25519.PublicKey
-	Coords []uint64
+	Key               ed25519.PublicKey
+	Root              ed25519.PublicKey
+	Coords            []uint64
+	CertificateExpiry time.Time // When the self-signed TLS certificate expires, it is renewed before then
 }
 
 type Peer struct {
-	Key     ed25519.PublicKey
-	Root    ed25519.PublicKey
-	Coords  []uint64
-	Port    uint64
-	Remote  string
-	RXBytes uint64
-	TXBytes uint64
-	Uptime  time.Duration
+	Key       ed25519.PublicKey
+	Root      ed25519.PublicKey
+	Coords    []uint64
+	Port      uint64
+	Remote    string
+	Address   string   // The address that an outgoing link connected to, out of all those for its name
+	Name      string   // The name given to the peer or listener with ?name=
+	Tags      []string // The tags given to the peer or listener with ?tags=
+	RXBytes   uint64
+	TXBytes   uint64
+	RXRate    uint64 // Bytes received in the last second
+	TXRate    uint64 // Bytes sent in the last second
+	MaxRXRate uint64 // Receive rate limit in bytes per second, 0 if none
+	MaxTXRate uint64 // Transmit rate limit in bytes per second, 0 if none
+	Uptime    time.Duration
+	Measured  bool          // Whether the link has been pinged, which needs support on both sides
+	RTT       time.Duration // Smoothed round-trip time of the link
+	Jitter    time.Duration // Smoothed mean deviation of the round-trip time
+	Loss      float64       // Estimated fraction of packets lost, between 0 and 1
+}
+
+// PeerStatus describes a configured peer, which is called again whenever it
+// disconnects. State is one of "connected", "dialing", "backing off" or
+// "failed", the last of which means that the URI can't be used. A srv:// peer
+// is instead "resolving", "resolved" or "backing off" if it couldn't be looked
+// up, and each of the targets that it has been expanded into is listed as a
+// peer of its own.
+type PeerStatus struct {
+	URI         string
+	Interface   string
+	State       string
+	LastError   error     // The reason that the last attempt failed or the link went down
+	NextAttempt time.Time // When the peer will be called again, if backing off
+}
+
+// DroppedConnections counts the incoming connections that have been dropped
+// by the listeners' flood protection, for each reason.
+type DroppedConnections struct {
+	SourceNotAllowed  uint64 // From a source that isn't allowed
+	SourceRateLimited uint64 // From a source that has opened too many recently
+	TooManyHandshakes uint64 // While too many handshakes were already in progress
+	HandshakeTimeout  uint64 // Because the handshake didn't finish in time
 }
 
 type DHTEntry struct {
@@ -59,15 +96,16 @@ func (c *Core) GetSelf() Self {
 	self.Key = s.Key
 	self.Root = s.Root
 	self.Coords = s.Coords
+	self.CertificateExpiry = c.links.tcp.tls.expiry()
 	return self
 }
 
 func (c *Core) GetPeers() []Peer {
 	var peers []Peer
-	names := make(map[net.Conn]string)
+	links := make(map[net.Conn]*link)
 	c.links.mutex.Lock()
-	for _, info := range c.links.links {
-		names[info.conn] = info.lname
+	for _, intf := range c.links.links {
+		links[intf.conn] = intf
 	}
 	c.links.mutex.Unlock()
 	ps := c.PacketConn.PacketConn.Debug.GetPeers()
@@ -78,13 +116,28 @@ func (c *Core) GetPeers() []Peer {
 		info.Coords = p.Coords
 		info.Port = p.Port
 		info.Remote = p.Conn.RemoteAddr().String()
-		if name := names[p.Conn]; name != "" {
-			info.Remote = name
+		if intf := links[p.Conn]; intf != nil {
+			if intf.lname != "" {
+				info.Remote = intf.lname
+			}
+			info.Address = intf.addr
+			info.Name = intf.options.name
+			info.Tags = slices.Clone(intf.options.tags)
 		}
 		if linkconn, ok := p.Conn.(*linkConn); ok {
 			info.RXBytes = atomic.LoadUint64(&linkconn.rx)
 			info.TXBytes = atomic.LoadUint64(&linkconn.tx)
+			info.RXRate = atomic.LoadUint64(&linkconn.rxRate)
+			info.TXRate = atomic.LoadUint64(&linkconn.txRate)
+			info.MaxRXRate = linkconn.maxRXRate
+			info.MaxTXRate = linkconn.maxTXRate
 			info.Uptime = time.Since(linkconn.up)
+			var stats linkStats
+			if stats, info.Measured = linkconn.getStats(); info.Measured {
+				info.RTT = stats.rtt
+				info.Jitter = stats.jitter
+				info.Loss = stats.loss
+			}
 		}
 		peers = append(peers, info)
 	}
@@ -127,13 +180,72 @@ func (c *Core) GetSessions() []Session {
 	return sessions
 }
 
-// Listen starts a new listener (either TCP or TLS). The input should be a url.URL
-// parsed from a string of the form e.g. "tcp://a.b.c.d:e". In the case of a
-// link-local address, the interface should be provided as the second argument.
+// Listen starts a new listener (TCP, TLS, QUIC, WebSocket, UNIX or a registered
+// transport). The input should be a url.URL parsed from a string of the form
+// e.g. "tcp://a.b.c.d:e" or "ws://a.b.c.d:e/path". In the case of a link-local
+// address, the interface should be provided as the second argument.
 func (c *Core) Listen(u *url.URL, sintf string) (*TcpListener, error) {
 	return c.links.tcp.listenURL(u, sintf)
 }
 
+// RegisterTransport adds a link type for peer and listener URIs with the given
+// scheme, which can't be one of the built-in ones such as "tcp" or "tls". This
+// should be called before Start if the configuration has peers or listeners
+// that use it.
+func (c *Core) RegisterTransport(scheme string, t Transport) error {
+	return c.links.tcp.registerTransport(scheme, t)
+}
+
+// PeerConnOptions describes a connection that is given to HandlePeerConn.
+type PeerConnOptions struct {
+	Incoming   bool                // Whether the remote side opened the connection, in which case AllowedPublicKeys applies and it must send its metadata first, so only one side should be incoming
+	PinnedKeys []ed25519.PublicKey // If not empty, the remote side must have one of these keys
+	Name       string              // Shown in the logs and GetPeers, e.g. "ssh://example.com", where the scheme is the link type
+}
+
+// HandlePeerConn runs a link over a connection that the application has made
+// itself, e.g. over an SSH channel, and blocks until the link closes. The
+// handshake is the same as for any other link, and the connection is closed
+// when HandlePeerConn returns. If there is no Name then the connection's
+// remote address is used, with a link type of "conn". If there is already a
+// link to the same node with the same Name then the connection isn't used, and
+// HandlePeerConn returns an error as soon as the handshake finds that out,
+// rather than waiting for the other link to close.
+func (c *Core) HandlePeerConn(conn net.Conn, options PeerConnOptions) error {
+	var running bool
+	phony.Block(c, func() {
+		running = c.peers != nil
+	})
+	if !running {
+		conn.Close()
+		return errors.New("node is not running")
+	}
+	tcpOpts := tcpOptions{connName: options.Name}
+	if tcpOpts.connName == "" {
+		tcpOpts.connName = conn.RemoteAddr().String()
+	}
+	if scheme, _, found := strings.Cut(tcpOpts.connName, "://"); found {
+		tcpOpts.proto = scheme
+	} else {
+		tcpOpts.proto = "conn"
+		tcpOpts.connName = "conn://" + tcpOpts.connName
+	}
+	if len(options.PinnedKeys) > 0 {
+		tcpOpts.pinnedEd25519Keys = make(map[keyArray]struct{})
+		for _, key := range options.PinnedKeys {
+			var k keyArray
+			copy(k[:], key)
+			tcpOpts.pinnedEd25519Keys[k] = struct{}{}
+		}
+	}
+	c.links.tcp.waitgroup.Add(1)
+	ch, err := c.links.tcp.handler(conn, options.Incoming, tcpOpts)
+	if ch != nil {
+		return errors.New("already connected to this node over " + tcpOpts.proto)
+	}
+	return err
+}
+
 // Address gets the IPv6 address of the Yggdrasil node. This is always a /128
 // address. The IPv6 address is only relevant when the node is operating as an
 // IP router and often is meaningless when embedded into an application, unless
@@ -168,74 +280,137 @@ func (c *Core) SetLogger(log *log.Logger) {
 //		socks://a.b.c.d:e/f.g.h.i:j
 // This adds the peer to the peer list, so that they will be called again if the
 // connection drops.
-/*
-func (c *Core) AddPeer(addr string, sintf string) error {
-	if err := c.CallPeer(addr, sintf); err != nil {
-		// TODO: We maybe want this to write the peer to the persistent
-		// configuration even if a connection attempt fails, but first we'll need to
-		// move the code to check the peer URI so that we don't deliberately save a
-		// peer with a known bad URI. Loading peers from config should really do the
-		// same thing too but I don't think that happens today
-		return err
+func (c *Core) AddPeer(uri string, sintf string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("peer %s is not correctly formatted (%s)", uri, err)
 	}
-	c.config.Mutex.Lock()
-	defer c.config.Mutex.Unlock()
-	if sintf == "" {
-		for _, peer := range c.config.Current.Peers {
-			if peer == addr {
-				return errors.New("peer already added")
-			}
+	phony.Block(c, func() {
+		key := peerKey{u.String(), sintf}
+		if c.peers == nil {
+			err = errors.New("node is not running")
+			return
 		}
-		c.config.Current.Peers = append(c.config.Current.Peers, addr)
-	} else {
-		if _, ok := c.config.Current.InterfacePeers[sintf]; ok {
-			for _, peer := range c.config.Current.InterfacePeers[sintf] {
-				if peer == addr {
-					return errors.New("peer already added")
-				}
+		if _, ok := c.peers[key]; ok {
+			err = errors.New("peer already added")
+			return
+		}
+		c.config.Lock()
+		defer c.config.Unlock()
+		peers := c.config.Peers
+		if sintf != "" {
+			peers = c.config.InterfacePeers[sintf]
+		}
+		for _, peer := range peers {
+			if peerURIEqual(peer, u) {
+				err = errors.New("peer already added")
+				return
 			}
 		}
-		if _, ok := c.config.Current.InterfacePeers[sintf]; !ok {
-			c.config.Current.InterfacePeers[sintf] = []string{addr}
+		// Calling the peer checks that the URI is one that we know how to use, so
+		// that we don't save a peer that will never work
+		if err = c._addConfiguredPeer(key, u); err != nil {
+			delete(c.peers, key)
+			return
+		}
+		if sintf == "" {
+			c.config.Peers = append(c.config.Peers, uri)
 		} else {
-			c.config.Current.InterfacePeers[sintf] = append(c.config.Current.InterfacePeers[sintf], addr)
+			if c.config.InterfacePeers == nil {
+				c.config.InterfacePeers = make(map[string][]string)
+			}
+			c.config.InterfacePeers[sintf] = append(c.config.InterfacePeers[sintf], uri)
 		}
-	}
-	return nil
+	})
+	return err
 }
-*/
-
-/*
-func (c *Core) RemovePeer(addr string, sintf string) error {
-	if sintf == "" {
-		for i, peer := range c.config.Current.Peers {
-			if peer == addr {
-				c.config.Current.Peers = append(c.config.Current.Peers[:i], c.config.Current.Peers[i+1:]...)
+
+// RemovePeer removes a peer that was previously added, either with AddPeer or
+// from the configuration, and closes any links that are currently open to it.
+// The peer should be specified in the same format as AddPeer.
+func (c *Core) RemovePeer(uri string, sintf string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("peer %s is not correctly formatted (%s)", uri, err)
+	}
+	phony.Block(c, func() {
+		c.config.Lock()
+		peers := c.config.Peers
+		if sintf != "" {
+			peers = c.config.InterfacePeers[sintf]
+		}
+		removed := false
+		for i, peer := range peers {
+			if peerURIEqual(peer, u) {
+				peers = append(peers[:i:i], peers[i+1:]...)
+				removed = true
 				break
 			}
 		}
-	} else if _, ok := c.config.Current.InterfacePeers[sintf]; ok {
-		for i, peer := range c.config.Current.InterfacePeers[sintf] {
-			if peer == addr {
-				c.config.Current.InterfacePeers[sintf] = append(c.config.Current.InterfacePeers[sintf][:i], c.config.Current.InterfacePeers[sintf][i+1:]...)
-				break
+		if removed {
+			if sintf == "" {
+				c.config.Peers = peers
+			} else {
+				c.config.InterfacePeers[sintf] = peers
 			}
 		}
-	}
+		c.config.Unlock()
+		if !removed {
+			err = errors.New("peer not found")
+			return
+		}
+		if p, ok := c.peers[peerKey{u.String(), sintf}]; ok {
+			c._removeConfiguredPeer(p)
+		} else {
+			c.links.closeCalled(u, sintf)
+		}
+	})
+	return err
+}
 
-	panic("TODO") // Get the net.Conn to this peer (if any) and close it
-	c.peers.Act(nil, func() {
-		ports := c.peers.ports
-		for _, peer := range ports {
-			if addr == peer.intf.name() {
-				c.peers._removePeer(peer)
-			}
+// GetPeerStatus gets the state of each of the configured peers, i.e. those in
+// the Peers and InterfacePeers sections of the configuration and those added
+// with AddPeer, sorted by URI.
+func (c *Core) GetPeerStatus() []PeerStatus {
+	var statuses []PeerStatus
+	phony.Block(c, func() {
+		for _, p := range c.peers {
+			statuses = append(statuses, PeerStatus{
+				URI:         p.key.uri,
+				Interface:   p.key.sintf,
+				State:       p.state,
+				LastError:   p.lastErr,
+				NextAttempt: p.next,
+			})
+		}
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].URI != statuses[j].URI {
+			return statuses[i].URI < statuses[j].URI
 		}
+		return statuses[i].Interface < statuses[j].Interface
 	})
+	return statuses
+}
 
-	return nil
+// GetDroppedConnections gets the number of incoming connections that have been
+// dropped by the listeners since the node was started.
+func (c *Core) GetDroppedConnections() DroppedConnections {
+	drops := &c.links.tcp.accept.drops
+	return DroppedConnections{
+		SourceNotAllowed:  drops.source.Load(),
+		SourceRateLimited: drops.rate.Load(),
+		TooManyHandshakes: drops.handshakes.Load(),
+		HandshakeTimeout:  drops.timeout.Load(),
+	}
+}
+
+// Checks if a peer URI string from the configuration refers to the same peer
+// as the given URL.
+func peerURIEqual(peer string, u *url.URL) bool {
+	pu, err := url.Parse(peer)
+	return err == nil && pu.String() == u.String()
 }
-*/
 
 // CallPeer calls a peer once. This should be specified in the peer URI format,
 // e.g.:
@@ -244,7 +419,7 @@ func (c *Core) RemovePeer(addr string, sintf string) error {
 // This does not add the peer to the peer list, so if the connection drops, the
 // peer will not be called again automatically.
 func (c *Core) CallPeer(u *url.URL, sintf string) error {
-	return c.links.call(u, sintf)
+	return c.links.call(u, sintf, linkOptions{})
 }
 
 func (c *Core) PublicKey() ed25519.PublicKey {
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
-	"net/url"
 	"time"
 
 	iwe "github.com/Arceliar/ironwood/encrypted"
@@ -36,6 +35,10 @@ type Core struct {
 	proto        protoHandler
 	log          *log.Logger
 	addPeerTimer *time.Timer
+	peers        map[peerKey]*configuredPeer // Configured peers, only used by the actor
+	interfacesUp map[string]struct{}         // Network interfaces that were up when last checked
+	peersFile    peersFile                   // The peers file as last read, only used by the actor
+	events       events                      // Subscribers to link and listener events
 	ctx          context.Context
 	ctxCancel    context.CancelFunc
 }
@@ -72,50 +75,6 @@ func (c *Core) _init() error {
 	return err
 }
 
-// If any static peers were provided in the configuration above then we should
-// configure them. The loop ensures that disconnected peers will eventually
-// be reconnected with.
-func (c *Core) _addPeerLoop() {
-	c.config.RLock()
-	defer c.config.RUnlock()
-
-	if c.addPeerTimer == nil {
-		return
-	}
-
-	// Add peers from the Peers section
-	for _, peer := range c.config.Peers {
-		go func(peer string, intf string) {
-			u, err := url.Parse(peer)
-			if err != nil {
-				c.log.Errorln("Failed to parse peer url:", peer, err)
-			}
-			if err := c.CallPeer(u, intf); err != nil {
-				c.log.Errorln("Failed to add peer:", err)
-			}
-		}(peer, "") // TODO: this should be acted and not in a goroutine?
-	}
-
-	// Add peers from the InterfacePeers section
-	for intf, intfpeers := range c.config.InterfacePeers {
-		for _, peer := range intfpeers {
-			go func(peer string, intf string) {
-				u, err := url.Parse(peer)
-				if err != nil {
-					c.log.Errorln("Failed to parse peer url:", peer, err)
-				}
-				if err := c.CallPeer(u, intf); err != nil {
-					c.log.Errorln("Failed to add peer:", err)
-				}
-			}(peer, intf) // TODO: this should be acted and not in a goroutine?
-		}
-	}
-
-	c.addPeerTimer = time.AfterFunc(time.Minute, func() {
-		c.Act(nil, c._addPeerLoop)
-	})
-}
-
 // Start starts up Yggdrasil using the provided config.NodeConfig, and outputs
 // debug logging through the provided log.Logger. The started stack will include
 // TCP and UDP sockets, a multicast discovery socket, an admin socket, router,
@@ -151,6 +110,7 @@ func (c *Core) _start(nc *config.NodeConfig, log *log.Logger) error {
 		return err
 	}
 
+	c.peers = make(map[peerKey]*configuredPeer)
 	c.addPeerTimer = time.AfterFunc(0, func() {
 		c.Act(nil, c._addPeerLoop)
 	})
@@ -184,6 +144,7 @@ func (c *Core) _close() error {
 		c.addPeerTimer.Stop()
 		c.addPeerTimer = nil
 	}
+	c._stopConfiguredPeers()
 	_ = c.links.stop()
 	return err
 }
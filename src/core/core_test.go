@@ -2,13 +2,37 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/gologme/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/time/rate"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 	"github.com/yggdrasil-network/yggdrasil-go/src/defaults"
@@ -37,35 +61,40 @@ func GetLoggerWithPrefix(prefix string, verbose bool) *log.Logger {
 	return l
 }
 
-// CreateAndConnectTwo creates two nodes. nodeB connects to nodeA.
-// Verbosity flag is passed to logger.
-func CreateAndConnectTwo(t testing.TB, verbose bool) (nodeA *Core, nodeB *Core) {
+// CreateTwo creates two nodes, where nodeA listens on the given listener URI,
+// without connecting them. Verbosity flag is passed to logger.
+func CreateTwo(t testing.TB, listen string, verbose bool) (nodeA *Core, nodeB *Core) {
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{listen}
 	nodeA = new(Core)
-	if err := nodeA.Start(GenerateConfig(), GetLoggerWithPrefix("A: ", verbose)); err != nil {
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", verbose)); err != nil {
 		t.Fatal(err)
 	}
 
 	nodeB = new(Core)
 	if err := nodeB.Start(GenerateConfig(), GetLoggerWithPrefix("B: ", verbose)); err != nil {
+		nodeA.Stop()
 		t.Fatal(err)
 	}
 
-	u, err := url.Parse("tcp://" + nodeA.links.tcp.getAddr().String())
+	return nodeA, nodeB
+}
+
+// CreateAndConnectTwo creates two nodes, where nodeA listens on the given
+// listener URI and nodeB calls the given peer URI, in which %s is replaced
+// with the address that nodeA is listening on, and waits for them to connect.
+// Verbosity flag is passed to logger.
+func CreateAndConnectTwo(t testing.TB, listen, peer string, verbose bool) (nodeA *Core, nodeB *Core) {
+	nodeA, nodeB = CreateTwo(t, listen, verbose)
+	u, err := url.Parse(fmt.Sprintf(peer, WaitListener(t, nodeA)))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = nodeB.CallPeer(u, "")
-	if err != nil {
+	if err = nodeB.CallPeer(u, ""); err != nil {
 		t.Fatal(err)
 	}
-
-	time.Sleep(100 * time.Millisecond)
-
-	if l := len(nodeA.GetPeers()); l != 1 {
-		t.Fatal("unexpected number of peers", l)
-	}
-	if l := len(nodeB.GetPeers()); l != 1 {
-		t.Fatal("unexpected number of peers", l)
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
 	}
 
 	return nodeA, nodeB
@@ -83,6 +112,38 @@ func WaitConnected(nodeA, nodeB *Core) bool {
 	return false
 }
 
+// ListenerAddr waits for the node's first TCP listener to start, since that
+// happens in the background, and gets its address.
+func ListenerAddr(t testing.TB, node *Core) *net.TCPAddr {
+	for i := 0; i < 50; i++ {
+		if addr := node.links.tcp.getAddr(); addr != nil {
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("listener did not start")
+	return nil
+}
+
+// WaitListener waits for one of the node's listeners of any type to start, and
+// gets its address, which is a path for UNIX sockets.
+func WaitListener(t testing.TB, node *Core) net.Addr {
+	for i := 0; i < 50; i++ {
+		var addr net.Addr
+		node.links.tcp.mutex.Lock()
+		for _, l := range node.links.tcp.listeners {
+			addr = l.Listener.Addr()
+		}
+		node.links.tcp.mutex.Unlock()
+		if addr != nil {
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("listener did not start")
+	return nil
+}
+
 // CreateEchoListener creates a routine listening on nodeA. It expects repeats messages of length bufLen.
 // It returns a channel used to synchronize the routine with caller.
 func CreateEchoListener(t testing.TB, nodeA *Core, bufLen int, repeats int) chan struct{} {
@@ -117,12 +178,1658 @@ func CreateEchoListener(t testing.TB, nodeA *Core, bufLen int, repeats int) chan
 
 // TestCore_Start_Connect checks if two nodes can connect together.
 func TestCore_Start_Connect(t *testing.T) {
-	CreateAndConnectTwo(t, true)
+	nodeA, nodeB := CreateAndConnectTwo(t, "tcp://127.0.0.1:0", "tcp://%s", true)
+	nodeA.Stop()
+	nodeB.Stop()
+}
+
+// ConnectTwoOver creates two nodes, where nodeA listens on the given listener
+// URI and nodeB connects to it using the given scheme, and checks that they
+// peer with each other using that link type.
+func ConnectTwoOver(t *testing.T, listen, scheme string) {
+	nodeA, nodeB := CreateAndConnectTwo(t, listen, scheme+"://%s", true)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+
+	for _, p := range nodeB.GetPeers() {
+		if !strings.HasPrefix(p.Remote, scheme+"://") {
+			t.Fatal("unexpected peer remote", p.Remote)
+		}
+	}
+}
+
+// TestCore_Start_ConnectQUIC checks if two nodes can connect together over QUIC.
+func TestCore_Start_ConnectQUIC(t *testing.T) {
+	ConnectTwoOver(t, "quic://127.0.0.1:0", "quic")
+}
+
+// TestCore_Start_ConnectWS checks if two nodes can connect together over WebSockets.
+func TestCore_Start_ConnectWS(t *testing.T) {
+	ConnectTwoOver(t, "ws://127.0.0.1:0", "ws")
+}
+
+// TestCore_Start_ConnectUNIX checks if two nodes can connect together over a UNIX socket.
+func TestCore_Start_ConnectUNIX(t *testing.T) {
+	ConnectTwoOver(t, "unix://"+filepath.Join(t.TempDir(), "ygg.sock"), "unix")
+}
+
+// TestCore_ListenUNIXExisting checks that a UNIX listener replaces a socket
+// left behind by a previous run, but leaves anything else at its path alone.
+func TestCore_ListenUNIXExisting(t *testing.T) {
+	node := new(Core)
+	if err := node.Start(GenerateConfig(), GetLoggerWithPrefix("A: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	file := filepath.Join(t.TempDir(), "ygg.conf")
+	if err := os.WriteFile(file, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("unix://" + file)
+	if _, err := node.Listen(u, ""); err == nil {
+		t.Fatal("listening over an ordinary file should have failed")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("ordinary file was removed:", err)
+	}
+
+	stale := filepath.Join(t.TempDir(), "ygg.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	u, _ = url.Parse("unix://" + stale)
+	listener, err := node.Listen(u, "")
+	if err != nil {
+		t.Fatal("stale socket was not replaced:", err)
+	}
+	listener.Stop()
+}
+
+// TestCore_Start_ConnectHTTPProxy checks if two nodes can connect together
+// through an HTTP CONNECT proxy that requires authentication.
+func TestCore_Start_ConnectHTTPProxy(t *testing.T) {
+	for _, scheme := range []string{"tcp", "tls"} {
+		t.Run(scheme, func(t *testing.T) {
+			proxy, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+			go func() {
+				_ = http.Serve(proxy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if user, pass, ok := parseProxyAuth(r); !ok || user != "user" || pass != "pass" {
+						w.WriteHeader(http.StatusProxyAuthRequired)
+						return
+					}
+					dst, err := net.Dial("tcp", r.Host)
+					if err != nil {
+						w.WriteHeader(http.StatusBadGateway)
+						return
+					}
+					src, _, _ := w.(http.Hijacker).Hijack()
+					_, _ = src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+					go func() { _, _ = io.Copy(dst, src); dst.Close() }()
+					_, _ = io.Copy(src, dst)
+					src.Close()
+				}))
+			}()
+
+			nodeA, nodeB := CreateTwo(t, scheme+"://127.0.0.1:0", true)
+			defer nodeA.Stop()
+			defer nodeB.Stop()
+
+			uri := "http-proxy://user:pass@" + proxy.Addr().String() + "/" + ListenerAddr(t, nodeA).String()
+			if scheme == "tcp" {
+				uri += "?tls=false"
+			}
+			u, err := url.Parse(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = nodeB.CallPeer(u, ""); err != nil {
+				t.Fatal(err)
+			}
+			if !WaitConnected(nodeA, nodeB) {
+				t.Fatal("nodes did not connect")
+			}
+			for _, p := range nodeB.GetPeers() {
+				if !strings.HasPrefix(p.Remote, "http-proxy://"+proxy.Addr().String()+"/") {
+					t.Fatal("unexpected peer remote", p.Remote)
+				}
+			}
+		})
+	}
+}
+
+// Gets the credentials from a Proxy-Authorization header.
+func parseProxyAuth(r *http.Request) (string, string, bool) {
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	return r.BasicAuth()
+}
+
+// TestCore_Start_ConnectProxyProtocol checks that a listener with
+// ?proxyprotocol=1 takes the remote address from the PROXY protocol header
+// sent by a load balancer, for both versions of the header.
+func TestCore_Start_ConnectProxyProtocol(t *testing.T) {
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+	v2 = append(v2, net.ParseIP("2001:db8::1")...)
+	v2 = append(v2, net.ParseIP("2001:db8::2")...)
+	v2 = append(v2, 0x9c, 0x40, 0x01, 0xbb)
+	for _, test := range []struct {
+		scheme string
+		header []byte
+		remote string
+	}{
+		{"tcp", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 443\r\n"), "tcp://192.0.2.1:40000"},
+		{"tls", v2, "tls://[2001:db8::1]:40000"},
+	} {
+		t.Run(test.scheme, func(t *testing.T) {
+			nodeA, nodeB := CreateTwo(t, test.scheme+"://127.0.0.1:0?proxyprotocol=1&proxysource=127.0.0.1", true)
+			defer nodeA.Stop()
+			defer nodeB.Stop()
+
+			// Stands in for the load balancer
+			lb, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lb.Close()
+			addrA := ListenerAddr(t, nodeA).String()
+			go func() {
+				src, err := lb.Accept()
+				if err != nil {
+					return
+				}
+				dst, err := net.Dial("tcp", addrA)
+				if err != nil {
+					src.Close()
+					return
+				}
+				_, _ = dst.Write(test.header)
+				go func() { _, _ = io.Copy(dst, src); dst.Close() }()
+				_, _ = io.Copy(src, dst)
+				src.Close()
+			}()
+
+			u, err := url.Parse(test.scheme + "://" + lb.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = nodeB.CallPeer(u, ""); err != nil {
+				t.Fatal(err)
+			}
+			if !WaitConnected(nodeA, nodeB) {
+				t.Fatal("nodes did not connect")
+			}
+			for _, p := range nodeA.GetPeers() {
+				if p.Remote != test.remote {
+					t.Fatal("unexpected peer remote", p.Remote)
+				}
+			}
+		})
+	}
+}
+
+// TestCore_ProxyProtocolSources checks that a listener with ?proxyprotocol=1
+// only reads PROXY protocol headers from the load balancers in ?proxysource=,
+// so that nobody else can claim to be from an address that it allows.
+func TestCore_ProxyProtocolSources(t *testing.T) {
+	for _, listen := range []string{
+		"tcp://127.0.0.1:0?proxyprotocol=1",
+		"tcp://127.0.0.1:0?proxysource=127.0.0.1",
+		"tcp://127.0.0.1:0?proxyprotocol=1&proxysource=nonsense",
+	} {
+		cfg := GenerateConfig()
+		cfg.Listen = []string{listen}
+		if err := new(Core).Start(cfg, GetLoggerWithPrefix("A: ", true)); err == nil {
+			t.Fatal("listener should have failed:", listen)
+		}
+	}
+
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"tcp://127.0.0.1:0?proxyprotocol=1&proxysource=192.0.2.1"}
+	cfgA.AllowedListenSources = []string{"192.0.2.0/24"}
+	nodeA := new(Core)
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	conn, err := net.Dial("tcp", ListenerAddr(t, nodeA).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.2 192.0.2.3 40000 443\r\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("connection should have been closed, got", err)
+	}
+	if nodeA.GetDroppedConnections().SourceNotAllowed != 1 {
+		t.Fatal("connection from an untrusted load balancer was not counted")
+	}
+}
+
+// TestCore_SourceFilter checks which addresses are accepted by lists of
+// allowed and denied sources.
+func TestCore_SourceFilter(t *testing.T) {
+	f, err := newSourceFilter([]string{"192.0.2.0/24, 2001:db8::/32"}, []string{"192.0.2.1", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, expected := range map[string]bool{
+		"192.0.2.2":        true,
+		"::ffff:192.0.2.2": true,
+		"192.0.2.1":        false,
+		"198.51.100.1":     false,
+		"2001:db8::1":      true,
+		"2001:db8:1::1":    false,
+		"fe80::1%eth0":     false,
+	} {
+		if allowed := f.allows(netip.MustParseAddr(s)); allowed != expected {
+			t.Fatalf("allows(%s) = %v", s, allowed)
+		}
+	}
+	if _, err := newSourceFilter([]string{"192.0.2.0/33"}, nil); err == nil {
+		t.Fatal("invalid prefix should have failed")
+	}
+	if _, err := newSourceFilter(nil, []string{"example.com"}); err == nil {
+		t.Fatal("invalid address should have failed")
+	}
+}
+
+// TestCore_ListenSources checks that a listener drops connections from
+// sources that it doesn't allow before the handshake, and accepts others.
+func TestCore_ListenSources(t *testing.T) {
+	ConnectTwoOver(t, "tcp://127.0.0.1:0?allowsource=127.0.0.0/8", "tcp")
+
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"tls://127.0.0.1:0"}
+	cfgA.DeniedListenSources = []string{"127.0.0.1"}
+	nodeA := new(Core)
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	conn, err := net.Dial("tcp", ListenerAddr(t, nodeA).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("connection should have been closed, got", err)
+	}
+	if nodeA.GetDroppedConnections().SourceNotAllowed != 1 {
+		t.Fatal("rejected connection was not counted")
+	}
+
+	cfgB := GenerateConfig()
+	cfgB.Listen = []string{"tcp://127.0.0.1:0?denysource=nonsense"}
+	if err := new(Core).Start(cfgB, GetLoggerWithPrefix("B: ", true)); err == nil {
+		t.Fatal("invalid listener sources should have failed")
+	}
+}
+
+// TestCore_AcceptFlood checks that a listener drops connections once too
+// many handshakes are in progress or their source has opened too many, and
+// drops those that don't finish the handshake in time.
+func TestCore_AcceptFlood(t *testing.T) {
+	cfg := GenerateConfig()
+	cfg.Listen = []string{"tcp://127.0.0.1:0"}
+	cfg.HandshakeTimeout = 1
+	cfg.MaxPendingHandshakes = 1
+	cfg.SourceConnectionsPerMinute = 2
+	node := new(Core)
+	if err := node.Start(cfg, GetLoggerWithPrefix("", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ListenerAddr(t, node).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// Never finishes the handshake, so holds the only slot until it times out
+	idle := dial()
+	defer idle.Close()
+	for len(node.links.tcp.accept.handshakes) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, expected := range []DroppedConnections{
+		{TooManyHandshakes: 1},
+		{TooManyHandshakes: 1, SourceRateLimited: 1},
+	} {
+		conn := dial()
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatal("connection should have been dropped, got", err)
+		}
+		conn.Close()
+		if dropped := node.GetDroppedConnections(); dropped != expected {
+			t.Fatalf("unexpected dropped connections %+v", dropped)
+		}
+	}
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, idle); err != nil {
+		t.Fatal("connection should have been dropped, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("handshake took too long to time out:", elapsed)
+	}
+	for node.GetDroppedConnections().HandshakeTimeout != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testTransport is a Transport that carries links over TCP to whichever
+// address it is listening on, standing in for one from an application.
+type testTransport struct {
+	mutex sync.Mutex
+	addr  string
+}
+
+func (tr *testTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	tr.mutex.Lock()
+	addr := tr.addr
+	tr.mutex.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (tr *testTransport) Listen(u *url.URL) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tr.mutex.Lock()
+	tr.addr = listener.Addr().String()
+	tr.mutex.Unlock()
+	return listener, nil
+}
+
+// TestCore_RegisterTransport checks that two nodes can connect over a link
+// type that has been registered by the application.
+func TestCore_RegisterTransport(t *testing.T) {
+	transport := new(testTransport)
+	nodeA, nodeB := new(Core), new(Core)
+	for _, node := range []*Core{nodeA, nodeB} {
+		if err := node.RegisterTransport("relay", transport); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.RegisterTransport("relay", transport); err == nil {
+			t.Fatal("registering a scheme twice should have failed")
+		}
+	}
+	if err := nodeA.RegisterTransport("tcp", transport); err == nil {
+		t.Fatal("registering a built-in scheme should have failed")
+	}
+
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"relay://example"}
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	cfgB := GenerateConfig()
+	cfgB.Peers = []string{"relay://example"}
+	if err := nodeB.Start(cfgB, GetLoggerWithPrefix("B: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	for _, p := range nodeB.GetPeers() {
+		if !strings.HasPrefix(p.Remote, "relay://") {
+			t.Fatal("unexpected peer remote", p.Remote)
+		}
+	}
+
+	// Built-in link types that can't be listened on say so
+	for _, listen := range []string{"wss://127.0.0.1:0", "socks://127.0.0.1:1080"} {
+		u, _ := url.Parse(listen)
+		if l, err := nodeA.Listen(u, ""); err == nil || l != nil {
+			t.Fatal("listener should have failed:", listen)
+		}
+	}
+}
+
+// TestCore_HandlePeerConn checks that two nodes can connect over connections
+// that were made by the application, and that the calls return once the link
+// closes.
+func TestCore_HandlePeerConn(t *testing.T) {
+	nodeA, nodeB := new(Core), new(Core)
+	for _, node := range []*Core{nodeA, nodeB} {
+		if err := node.Start(GenerateConfig(), GetLoggerWithPrefix("", false)); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connB, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	connA, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- nodeA.HandlePeerConn(connA, PeerConnOptions{Incoming: true, Name: "ssh://b.example"})
+	}()
+	go func() {
+		errs <- nodeB.HandlePeerConn(connB, PeerConnOptions{PinnedKeys: []ed25519.PublicKey{nodeA.PublicKey()}})
+	}()
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	for node, expected := range map[*Core]string{
+		nodeA: "ssh://b.example",
+		nodeB: "conn://" + connB.RemoteAddr().String(),
+	} {
+		if peers := node.GetPeers(); len(peers) != 1 || peers[0].Remote != expected {
+			t.Fatalf("unexpected peers %+v", peers)
+		}
+	}
+
+	// Another connection with the same names duplicates the link, so it is
+	// refused straight away on both sides while the first link stays up
+	dupB, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupA, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupErrs := make(chan error, 2)
+	go func() {
+		dupErrs <- nodeA.HandlePeerConn(dupA, PeerConnOptions{Incoming: true, Name: "ssh://b.example"})
+	}()
+	go func() {
+		dupErrs <- nodeB.HandlePeerConn(dupB, PeerConnOptions{Name: "conn://" + connB.RemoteAddr().String()})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-dupErrs:
+			if err == nil || !strings.Contains(err.Error(), "already connected") {
+				t.Fatal("duplicate link should have been refused, got", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("HandlePeerConn blocked on a duplicate link")
+		}
+	}
+	if len(nodeA.GetPeers()) != 1 || len(nodeB.GetPeers()) != 1 {
+		t.Fatal("the first link should still be up")
+	}
+	connA.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(10 * time.Second):
+			t.Fatal("HandlePeerConn did not return after the link closed")
+		}
+	}
+
+	// The remote side's key must match the pinned key
+	connB, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connA, err = listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = nodeA.HandlePeerConn(connA, PeerConnOptions{Incoming: true})
+	}()
+	_, wrongKey, _ := ed25519.GenerateKey(nil)
+	if err := nodeB.HandlePeerConn(connB, PeerConnOptions{PinnedKeys: []ed25519.PublicKey{wrongKey.Public().(ed25519.PublicKey)}}); err == nil {
+		t.Fatal("connecting to the wrong key should have failed")
+	}
+}
+
+// TestCore_SubscribeEvents checks that events are sent when listeners start
+// and stop, when links go up and down, and when a handshake is rejected.
+func TestCore_SubscribeEvents(t *testing.T) {
+	waitEvent := func(events <-chan Event, typ EventType) Event {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Type == typ {
+					return event
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for", typ)
+			}
+		}
+	}
+
+	nodeA, nodeB := new(Core), new(Core)
+	eventsA, unsubscribeA := nodeA.SubscribeEvents()
+	defer unsubscribeA()
+	eventsB, unsubscribeB := nodeB.SubscribeEvents()
+	defer unsubscribeB()
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"tcp://127.0.0.1:0"}
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	stopA := sync.OnceFunc(nodeA.Stop)
+	defer stopA()
+	if event := waitEvent(eventsA, EventListenerStarted); event.LinkType != "tcp" || event.Local != ListenerAddr(t, nodeA).String() {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if err := nodeB.Start(GenerateConfig(), GetLoggerWithPrefix("B: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+
+	u, _ := url.Parse("tcp://" + ListenerAddr(t, nodeA).String())
+	if err := nodeB.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if event := waitEvent(eventsA, EventLinkUp); !bytes.Equal(event.Key, nodeB.PublicKey()) || !event.Inbound {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event := waitEvent(eventsB, EventLinkUp); !bytes.Equal(event.Key, nodeA.PublicKey()) || event.Inbound {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// The wrong key is pinned, so the link is rejected
+	nodeC := new(Core)
+	eventsC, unsubscribeC := nodeC.SubscribeEvents()
+	defer unsubscribeC()
+	if err := nodeC.Start(GenerateConfig(), GetLoggerWithPrefix("C: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeC.Stop()
+	_, wrongKey, _ := ed25519.GenerateKey(nil)
+	u, _ = url.Parse("tcp://" + ListenerAddr(t, nodeA).String() + "?key=" + hex.EncodeToString(wrongKey.Public().(ed25519.PublicKey)))
+	if err := nodeC.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if event := waitEvent(eventsC, EventHandshakeRejected); !bytes.Equal(event.Key, nodeA.PublicKey()) || event.Err == nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// QUIC checks the pinned key while dialing, and the error is wrapped
+	cfgD := GenerateConfig()
+	cfgD.Listen = []string{"quic://127.0.0.1:0"}
+	nodeD := new(Core)
+	eventsD, unsubscribeD := nodeD.SubscribeEvents()
+	defer unsubscribeD()
+	if err := nodeD.Start(cfgD, GetLoggerWithPrefix("D: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeD.Stop()
+	listenerD := waitEvent(eventsD, EventListenerStarted)
+	u, _ = url.Parse("quic://" + listenerD.Local + "?key=" + hex.EncodeToString(wrongKey.Public().(ed25519.PublicKey)))
+	if err := nodeC.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if event := waitEvent(eventsC, EventHandshakeRejected); event.LinkType != "quic" || !errors.Is(event.Err, errTLSPinnedKey) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	stopA()
+	waitEvent(eventsA, EventListenerStopped)
+	if event := waitEvent(eventsB, EventLinkDown); !bytes.Equal(event.Key, nodeA.PublicKey()) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+// TestCore_Start_ConnectOBFS checks that two nodes can connect over an
+// obfuscated link, that the plaintext metadata never appears on the wire, and
+// that a listener doesn't reply to anything else.
+func TestCore_Start_ConnectOBFS(t *testing.T) {
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"obfs://127.0.0.1:0"}
+	cfgA.HandshakeTimeout = 1
+	nodeA := new(Core)
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	nodeB := new(Core)
+	if err := nodeB.Start(GenerateConfig(), GetLoggerWithPrefix("B: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+
+	// Records what the listener sends, to check that it can't be picked out
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	addrA := ListenerAddr(t, nodeA).String()
+	var mutex sync.Mutex
+	var sent bytes.Buffer
+	go func() {
+		src, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		dst, err := net.Dial("tcp", addrA)
+		if err != nil {
+			src.Close()
+			return
+		}
+		go func() { _, _ = io.Copy(dst, src); dst.Close() }()
+		buf := make([]byte, 65535)
+		for {
+			n, err := dst.Read(buf)
+			mutex.Lock()
+			sent.Write(buf[:n])
+			mutex.Unlock()
+			if _, werr := src.Write(buf[:n]); err != nil || werr != nil {
+				break
+			}
+		}
+		src.Close()
+	}()
+
+	if u, _ := url.Parse("obfs://" + proxy.Addr().String()); nodeB.CallPeer(u, "") == nil {
+		t.Fatal("calling an obfs peer without a pinned key should have failed")
+	}
+	u, _ := url.Parse("obfs://" + proxy.Addr().String() + "?key=" + hex.EncodeToString(nodeA.PublicKey()))
+	if err := nodeB.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	mutex.Lock()
+	if bytes.Contains(sent.Bytes(), []byte("meta")) {
+		t.Fatal("metadata was sent in plaintext")
+	}
+	mutex.Unlock()
+
+	probe, err := net.Dial("tcp", addrA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	_, _ = probe.Write(bytes.Repeat([]byte("probe"), 100))
+	_ = probe.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := probe.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("listener should have closed the probe without replying, got", n, err)
+	}
+}
+
+// TestCore_DialAddresses checks that addresses are tried alternating between
+// families, and that an address that never answers doesn't stop the others
+// from being tried.
+func TestCore_DialAddresses(t *testing.T) {
+	addrs := []netip.AddrPort{
+		netip.MustParseAddrPort("[2001:db8::1]:1"),
+		netip.MustParseAddrPort("[2001:db8::2]:1"),
+		netip.MustParseAddrPort("192.0.2.1:1"),
+		netip.MustParseAddrPort("192.0.2.2:1"),
+	}
+	ordered := interleaveAddresses(addrs)
+	for i, want := range []int{0, 2, 1, 3} {
+		if ordered[i] != addrs[want] {
+			t.Fatalf("address %d is %s, expected %s", i, ordered[i], addrs[want])
+		}
+	}
+
+	// The first hangs, the second fails and the third connects
+	var tried []netip.AddrPort
+	var mutex sync.Mutex
+	conn, addr, err := dialAddresses(context.Background(), ordered, dialAttemptDelay, func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+		mutex.Lock()
+		tried = append(tried, addr)
+		mutex.Unlock()
+		switch addr {
+		case ordered[0]:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case ordered[1]:
+			return nil, errors.New("unreachable")
+		default:
+			a, b := net.Pipe()
+			b.Close()
+			return a, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if addr != ordered[2] {
+		t.Fatal("connected to", addr, "expected", ordered[2])
+	}
+	mutex.Lock()
+	if len(tried) != 3 {
+		t.Fatal("expected 3 attempts, got", tried)
+	}
+	mutex.Unlock()
+
+	_, _, err = dialAddresses(context.Background(), ordered, dialAttemptDelay, func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	if err == nil || !strings.Contains(err.Error(), ordered[3].String()) {
+		t.Fatal("expected an error for every address, got", err)
+	}
+}
+
+// TestCore_Start_ConnectByName checks that a peer can be called by name, and
+// that the address that was connected to is reported.
+func TestCore_Start_ConnectByName(t *testing.T) {
+	nodeA, nodeB := CreateTwo(t, "tcp://127.0.0.1:0", false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	addr := ListenerAddr(t, nodeA)
+	u, _ := url.Parse(fmt.Sprintf("tcp://localhost:%d", addr.Port))
+	if err := nodeB.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	peers := nodeB.GetPeers()
+	if len(peers) != 1 || peers[0].Address != addr.String() {
+		t.Fatalf("expected the peer to have connected to %s, got %+v", addr, peers)
+	}
+}
+
+// Serves DNS records for tests over UDP, and points dnsResolver at it until
+// the test is over. Names that aren't given any records don't exist.
+func fakeDNS(t *testing.T, records map[dnsmessage.Type]map[string][]dnsmessage.ResourceBody) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Header.Response, msg.Header.Authoritative = true, true
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			for qtype, names := range records {
+				if bodies, ok := names[q.Name.String()]; ok {
+					msg.Header.RCode = dnsmessage.RCodeSuccess
+					if qtype != q.Type {
+						continue
+					}
+					for _, body := range bodies {
+						msg.Answers = append(msg.Answers, dnsmessage.Resource{
+							Header: dnsmessage.ResourceHeader{Name: q.Name, Type: qtype, Class: dnsmessage.ClassINET, TTL: 60},
+							Body:   body,
+						})
+					}
+				}
+			}
+			if out, err := msg.Pack(); err == nil {
+				_, _ = conn.WriteTo(out, addr)
+			}
+		}
+	}()
+	resolver := dnsResolver
+	dnsResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	t.Cleanup(func() {
+		dnsResolver = resolver
+		conn.Close()
+	})
+}
+
+// TestCore_SRVPeer checks that a srv:// peer is expanded into the most
+// preferred of its targets, with the key pinned from a TXT record, and that
+// removing it removes the target too.
+func TestCore_SRVPeer(t *testing.T) {
+	var nodes []*Core
+	for _, prefix := range []string{"A: ", "B: ", "C: "} {
+		cfg := GenerateConfig()
+		cfg.Listen = []string{"tls://127.0.0.1:0"}
+		node := new(Core)
+		if err := node.Start(cfg, GetLoggerWithPrefix(prefix, false)); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+		nodes = append(nodes, node)
+	}
+	nodeA, nodeB, nodeC := nodes[0], nodes[1], nodes[2]
+	name := func(s string) dnsmessage.Name { return dnsmessage.MustNewName(s) }
+	localhost := []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}}
+	fakeDNS(t, map[dnsmessage.Type]map[string][]dnsmessage.ResourceBody{
+		dnsmessage.TypeSRV: {
+			"_yggdrasil._tcp.example.org.": {
+				&dnsmessage.SRVResource{Priority: 20, Weight: 1, Port: uint16(ListenerAddr(t, nodeC).Port), Target: name("c.example.org.")},
+				&dnsmessage.SRVResource{Priority: 10, Weight: 1, Port: uint16(ListenerAddr(t, nodeA).Port), Target: name("a.example.org.")},
+			},
+		},
+		dnsmessage.TypeTXT: {
+			"a.example.org.": {&dnsmessage.TXTResource{TXT: []string{"key=" + hex.EncodeToString(nodeA.PublicKey())}}},
+		},
+		dnsmessage.TypeA: {
+			"a.example.org.": localhost,
+			"c.example.org.": localhost,
+		},
+	})
+
+	if err := nodeB.AddPeer("srv://_yggdrasil._tcp.example.org?scheme=bogus", ""); err == nil {
+		t.Fatal("a srv:// peer with an unknown scheme should have been refused")
+	}
+	srv := "srv://_yggdrasil._tcp.example.org?count=1"
+	if err := nodeB.AddPeer(srv, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	target := fmt.Sprintf("tls://a.example.org:%d?key=%s", ListenerAddr(t, nodeA).Port, hex.EncodeToString(nodeA.PublicKey()))
+	states := map[string]string{}
+	for _, status := range nodeB.GetPeerStatus() {
+		states[status.URI] = status.State
+	}
+	if len(states) != 2 || states[srv] != peerStateResolved || states[target] != peerStateConnected {
+		t.Fatal("unexpected peer states:", states)
+	}
+	if len(nodeC.GetPeers()) != 0 {
+		t.Fatal("the less preferred target should not have been called")
+	}
+
+	if err := nodeB.RemovePeer(srv, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && len(nodeB.GetPeers()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(nodeB.GetPeers()) != 0 || len(nodeB.GetPeerStatus()) != 0 {
+		t.Fatal("removing the srv:// peer should have removed its target")
+	}
+}
+
+// TestCore_CallFromSource checks that a peer can be called from a given
+// source address and port, and that combinations that can't work are refused.
+func TestCore_CallFromSource(t *testing.T) {
+	nodeA, nodeB := CreateTwo(t, "tcp://127.0.0.1:0", false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	addr := ListenerAddr(t, nodeA).String()
+
+	for _, uri := range []string{
+		"tcp://" + addr + "?source=bogus",
+		"tcp://" + addr + "?source=127.0.0.1:99999",
+		"quic://" + addr + "?source=127.0.0.1:0",
+	} {
+		u, _ := url.Parse(uri)
+		if err := nodeB.CallPeer(u, ""); err == nil {
+			t.Fatal("calling", uri, "should have failed")
+		}
+	}
+	u, _ := url.Parse("tcp://" + addr + "?source=127.0.0.1")
+	if err := nodeB.links.call(u, "lo", linkOptions{}); err == nil {
+		t.Fatal("calling with both a source and an interface should have failed")
+	}
+	if _, err := nodeB.links.tcp.dialTCP(context.Background(), addr, &tcpOptions{source: &net.TCPAddr{IP: net.IPv6loopback}}, ""); err == nil || !strings.Contains(err.Error(), "can't reach") {
+		t.Fatal("calling an IPv4 address from an IPv6 source should have failed, got", err)
+	}
+	u, _ = url.Parse("tcp://127.0.0.1:0?source=127.0.0.1")
+	if _, err := nodeA.Listen(u, ""); err == nil {
+		t.Fatal("a listener with a source should have been refused")
+	}
+
+	// Find a free port to call from
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := l.Addr().String()
+	l.Close()
+	u, _ = url.Parse("tcp://" + addr + "?source=" + source)
+	if err := nodeB.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	if peers := nodeA.GetPeers(); len(peers) != 1 || peers[0].Remote != "tcp://"+source {
+		t.Fatalf("expected the link to come from %s, got %+v", source, peers)
+	}
+}
+
+// TestCore_PeerNames checks that the names and tags of peers and listeners
+// are given to their links.
+func TestCore_PeerNames(t *testing.T) {
+	nodeA, nodeB := CreateAndConnectTwo(t, "tcp://127.0.0.1:0?name=inbound&tags=public", "tcp://%s?name=backbone-1&tags=transit,eu&tags=transit", false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	if peers := nodeB.GetPeers(); len(peers) != 1 || peers[0].Name != "backbone-1" || strings.Join(peers[0].Tags, ",") != "transit,eu" {
+		t.Fatalf("unexpected name or tags for the outgoing link: %+v", peers)
+	}
+	if peers := nodeA.GetPeers(); len(peers) != 1 || peers[0].Name != "inbound" || strings.Join(peers[0].Tags, ",") != "public" {
+		t.Fatalf("unexpected name or tags for the incoming link: %+v", peers)
+	}
+}
+
+// TestCore_TLSCertRotation checks that the TLS certificate is renewed when it
+// is about to expire, without dropping links or stopping the listener.
+func TestCore_TLSCertRotation(t *testing.T) {
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"tls://127.0.0.1:0"}
+	nodeA := new(Core)
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	uri := "tls://" + ListenerAddr(t, nodeA).String()
+
+	connect := func(prefix string) *Core {
+		node := new(Core)
+		if err := node.Start(GenerateConfig(), GetLoggerWithPrefix(prefix, true)); err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(uri)
+		if err := node.CallPeer(u, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !WaitConnected(nodeA, node) {
+			t.Fatal("nodes did not connect")
+		}
+		return node
+	}
+	nodeB := connect("B: ")
+	defer nodeB.Stop()
+
+	// Pretend that the certificate is about to expire
+	old := nodeA.links.tcp.tls.cert.Load()
+	expiring, leaf := *old, *old.Leaf
+	leaf.NotAfter = time.Now().Add(time.Hour)
+	expiring.Leaf = &leaf
+	nodeA.links.tcp.tls.cert.Store(&expiring)
+	if expiry := nodeA.GetSelf().CertificateExpiry; !expiry.Equal(leaf.NotAfter) {
+		t.Fatal("unexpected certificate expiry", expiry)
+	}
+	nodeA.links.tcp.tls.rotate()
+	if cert := nodeA.links.tcp.tls.cert.Load(); cert.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) == 0 {
+		t.Fatal("certificate was not renewed")
+	}
+	if expiry := nodeA.GetSelf().CertificateExpiry; time.Until(expiry) < tlsCertLifetime-time.Minute {
+		t.Fatal("unexpected certificate expiry after renewal", expiry)
+	}
+
+	if l := len(nodeB.GetPeers()); l != 1 {
+		t.Fatal("link was dropped", l)
+	}
+	nodeC := connect("C: ")
+	defer nodeC.Stop()
+}
+
+// TestCore_TLSOperatorCert checks that a TLS listener can use a certificate
+// supplied by the operator, and that dialers can verify it against the system
+// roots while still getting the node's ed25519 key.
+func TestCore_TLSOperatorCert(t *testing.T) {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(crand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKeyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caFile := writePEM("ca.pem", "CERTIFICATE", caDER)
+	certFile := writePEM("cert.pem", "CERTIFICATE", leafDER)
+	keyFile := writePEM("key.pem", "EC PRIVATE KEY", leafKeyDER)
+	// Only the dialers that ask for it use the system roots, so this must be set
+	// before any of them are loaded
+	t.Setenv("SSL_CERT_FILE", caFile)
+
+	cfgA := GenerateConfig()
+	cfgA.Listen = []string{"tls://127.0.0.1:0?cert=" + certFile + "&key=" + keyFile}
+	nodeA := new(Core)
+	if err := nodeA.Start(cfgA, GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	addr := ListenerAddr(t, nodeA).String()
+
+	for _, query := range []string{"", "?verify=system", "?verify=system&key=" + hex.EncodeToString(nodeA.public)} {
+		nodeB := new(Core)
+		if err := nodeB.Start(GenerateConfig(), GetLoggerWithPrefix("B: ", true)); err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse("tls://" + addr + query)
+		if err := nodeB.CallPeer(u, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !WaitConnected(nodeA, nodeB) {
+			t.Fatal("nodes did not connect with", query)
+		}
+		nodeB.Stop()
+	}
+
+	// A pinned key that doesn't match must still be refused
+	nodeC := new(Core)
+	if err := nodeC.Start(GenerateConfig(), GetLoggerWithPrefix("C: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeC.Stop()
+	u, _ := url.Parse("tls://" + addr + "?verify=system&key=" + hex.EncodeToString(make([]byte, ed25519.PublicKeySize)))
+	if err := nodeC.CallPeer(u, ""); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if l := len(nodeC.GetPeers()); l != 0 {
+		t.Fatal("connected to a node that doesn't match the pinned key")
+	}
+}
+
+// TestCore_AddRemovePeer checks that peers can be added and removed at runtime,
+// and that removing a peer closes the link to it.
+func TestCore_AddRemovePeer(t *testing.T) {
+	nodeA, nodeB := CreateTwo(t, "tcp://127.0.0.1:0", true)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+
+	uri := "tcp://" + ListenerAddr(t, nodeA).String()
+	if err := nodeB.AddPeer(uri, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeB.AddPeer(uri, ""); err == nil {
+		t.Fatal("expected an error when adding a duplicate peer")
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+
+	if err := nodeB.RemovePeer(uri, ""); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(nodeB.config.Peers); l != 0 {
+		t.Fatal("unexpected number of configured peers", l)
+	}
+	for i := 0; i < 50 && len(nodeB.GetPeers()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if l := len(nodeB.GetPeers()); l != 0 {
+		t.Fatal("peer was not disconnected", l)
+	}
+	if err := nodeB.RemovePeer(uri, ""); err == nil {
+		t.Fatal("expected an error when removing an unknown peer")
+	}
+}
+
+// TestCore_RemovePeerDuringHandshake checks that removing a peer while a call
+// to it is still in its handshake closes the link once the handshake is done.
+func TestCore_RemovePeerDuringHandshake(t *testing.T) {
+	nodeA, nodeB := CreateTwo(t, "tcp://127.0.0.1:0", true)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+
+	// Holds the connection from node B until the peer has been removed, and
+	// then relays it to node A until either side closes it
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	addrA := ListenerAddr(t, nodeA).String()
+	accepted, release, closed := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(closed)
+		src, err := relay.Accept()
+		if err != nil {
+			return
+		}
+		defer src.Close()
+		close(accepted)
+		<-release
+		dst, err := net.Dial("tcp", addrA)
+		if err != nil {
+			return
+		}
+		defer dst.Close()
+		go func() { _, _ = io.Copy(dst, src); dst.Close() }()
+		_, _ = io.Copy(src, dst)
+	}()
+
+	uri := "tcp://" + relay.Addr().String()
+	if err := nodeB.AddPeer(uri, ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node B did not call the relay")
+	}
+	if err := nodeB.RemovePeer(uri, ""); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// The handshake still finishes, but the link mustn't stay up
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("link to the removed peer was not closed")
+	}
+	for i := 0; i < 50 && len(nodeB.GetPeers()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if l := len(nodeB.GetPeers()); l != 0 {
+		t.Fatal("peer was not disconnected", l)
+	}
+}
+
+// TestCore_PeerStatus checks that the state of a configured peer is tracked,
+// and that it backs off after the link goes down.
+func TestCore_PeerStatus(t *testing.T) {
+	nodeA, nodeB := CreateTwo(t, "tcp://127.0.0.1:0", true)
+	stopA := sync.OnceFunc(nodeA.Stop)
+	defer stopA()
+	defer nodeB.Stop()
+
+	uri := "tcp://" + ListenerAddr(t, nodeA).String()
+	if err := nodeB.AddPeer(uri, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitState := func(state string) PeerStatus {
+		var status []PeerStatus
+		for i := 0; i < 50; i++ {
+			if status = nodeB.GetPeerStatus(); len(status) == 1 && status[0].State == state {
+				return status[0]
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("peer did not reach state %q: %+v", state, status)
+		return PeerStatus{}
+	}
+	if status := waitState(peerStateConnected); status.URI != uri {
+		t.Fatal("unexpected peer URI", status.URI)
+	}
+
+	stopA()
+	status := waitState(peerStateBackoff)
+	if status.LastError == nil {
+		t.Fatal("expected the last error to be set")
+	}
+	if wait := time.Until(status.NextAttempt); wait <= 0 || wait > peerBackoffMin {
+		t.Fatal("unexpected next attempt time", status.NextAttempt)
+	}
+}
+
+// TestCore_PeersFile checks that peers are read from the peers file, and that
+// changes to it are applied without touching the links that haven't changed.
+func TestCore_PeersFile(t *testing.T) {
+	var nodes []*Core
+	for _, prefix := range []string{"A: ", "C: "} {
+		node := new(Core)
+		if err := node.Start(GenerateConfig(), GetLoggerWithPrefix(prefix, false)); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+		nodes = append(nodes, node)
+	}
+	nodeA, nodeC := nodes[0], nodes[1]
+	uriA := "tcp://" + ListenerAddr(t, nodeA).String()
+	uriC := "tcp://" + ListenerAddr(t, nodeC).String()
+
+	path := filepath.Join(t.TempDir(), "peers")
+	write := func(lines ...string) {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# Peers", uriA)
+	cfgB := GenerateConfig()
+	cfgB.PeersFile = path
+	nodeB := new(Core)
+	if err := nodeB.Start(cfgB, GetLoggerWithPrefix("B: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+	up := time.Now()
+
+	write("# Peers", uriA, "", uriC)
+	phony.Block(nodeB, nodeB._updateConfiguredPeers)
+	if !WaitConnected(nodeC, nodeB) {
+		t.Fatal("peer added to the file was not called")
+	}
+	if peers := nodeA.GetPeers(); len(peers) != 1 || peers[0].Uptime < time.Since(up) {
+		t.Fatal("link to an unchanged peer should have been left alone")
+	}
+
+	write(uriC)
+	phony.Block(nodeB, nodeB._updateConfiguredPeers)
+	for i := 0; i < 50 && len(nodeA.GetPeers()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(nodeA.GetPeers()) != 0 {
+		t.Fatal("peer removed from the file was not disconnected")
+	}
+	if status := nodeB.GetPeerStatus(); len(status) != 1 || status[0].URI != uriC {
+		t.Fatalf("unexpected peers: %+v", status)
+	}
+}
+
+// TestCore_LinkKeepAlive checks that an idle link sends keepalives, and that
+// reads time out if nothing is received.
+func TestCore_LinkKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &linkConn{Conn: local, up: time.Now()}
+	defer conn.Close()
+	conn.startKeepAlive(50*time.Millisecond, 100*time.Millisecond)
+
+	buf := make([]byte, len(linkKeepAliveMessage))
+	for i := 0; i < 2; i++ {
+		_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			t.Fatal("no keepalive received:", err)
+		}
+		if !bytes.Equal(buf, linkKeepAliveMessage) {
+			t.Fatal("unexpected keepalive", buf)
+		}
+	}
+
+	// The router would ask for a much longer deadline than this
+	if err := conn.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go func() { _, _ = io.Copy(io.Discard, remote) }()
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("expected the read to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("read timeout was not applied, took", elapsed)
+	}
+}
+
+// TestCore_LinkKeepAliveTimes checks that keepalives are only sent when the
+// router's aren't often enough for the read timeout that the remote side
+// sent, and that a short read timeout is only used with peers that will keep
+// the link alive for it.
+func TestCore_LinkKeepAliveTimes(t *testing.T) {
+	for _, test := range []struct {
+		keepAlive, readTimeout time.Duration // Ours
+		capabilities           version_capabilities
+		remoteTimeout          time.Duration
+		interval, timeout      time.Duration // Expected
+	}{
+		{linkKeepAliveDefault, linkReadTimeoutDefault, version_capKeepAlive, linkReadTimeoutDefault, 0, linkReadTimeoutDefault},
+		{linkKeepAliveDefault, linkReadTimeoutDefault, version_capKeepAlive, 3 * time.Second, 2 * time.Second, linkReadTimeoutDefault},
+		{linkKeepAliveDefault, linkReadTimeoutDefault, 0, 3 * time.Second, 0, linkReadTimeoutDefault},
+		{time.Second, 3 * time.Second, version_capKeepAlive, linkReadTimeoutDefault, time.Second, 3 * time.Second},
+		{time.Second, 3 * time.Second, 0, 0, time.Second, linkReadTimeoutDefault},
+		{10 * time.Second, 30 * time.Second, version_capKeepAlive, 30 * time.Second, 0, 30 * time.Second},
+	} {
+		intf := &link{
+			links:        &links{keepAlive: test.keepAlive, readTimeout: test.readTimeout},
+			capabilities: test.capabilities,
+		}
+		remote := version_metadata{readTimeout: uint32(test.remoteTimeout.Milliseconds())}
+		if interval, timeout := intf.keepAliveTimes(&remote); interval != test.interval || timeout != test.timeout {
+			t.Errorf("%+v: got interval %s and timeout %s", test, interval, timeout)
+		}
+	}
+}
+
+// TestCore_AcceptSourceRate checks which sources share a rate limit. Global
+// IPv6 sources share one with the rest of their /64, but link-local ones don't,
+// since every neighbour is in fe80::/64.
+func TestCore_AcceptSourceRate(t *testing.T) {
+	var a acceptGuard
+	a.init(0, 1)
+	for _, test := range []struct {
+		source  string
+		allowed bool
+	}{
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"fe80::1%eth0", true},
+		{"fe80::2%eth0", true},
+		{"fe80::1%eth1", true},
+		{"fe80::1%eth0", false},
+	} {
+		if allowed := a.allowRate(netip.MustParseAddr(test.source)); allowed != test.allowed {
+			t.Fatalf("allowRate(%s) = %v", test.source, allowed)
+		}
+	}
+}
+
+// TestCore_ParseRate checks that rate limits in URIs are parsed correctly.
+func TestCore_ParseRate(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1000": 1000,
+		"500k": 500000,
+		"10M":  10000000,
+		"1G":   1000000000,
+	} {
+		if rate, err := parseRate(s); err != nil || rate != expected {
+			t.Fatalf("parseRate(%q) = %d, %v", s, rate, err)
+		}
+	}
+	for _, s := range []string{"0", "k", "-1", "1.5M", "10T", "99999999999999999999"} {
+		if _, err := parseRate(s); err == nil {
+			t.Fatalf("parseRate(%q) should have failed", s)
+		}
+	}
+}
+
+// TestCore_LinkRateLimit checks that writes on a link are held to the rate limit.
+func TestCore_LinkRateLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &linkConn{
+		Conn:       local,
+		up:         time.Now(),
+		ctx:        context.Background(),
+		txLimiters: []*rate.Limiter{newLinkLimiter(50000)},
+	}
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, remote) }()
+
+	// The first linkRateBurst bytes can be sent straight away, and the rest
+	// should take at least a second
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, linkRateBurst+50000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatal("rate limit was not applied, took", elapsed)
+	}
+}
+
+// TestCore_LinkPing checks that links are pinged to measure their round-trip
+// time.
+func TestCore_LinkPing(t *testing.T) {
+	nodeA, nodeB := CreateAndConnectTwo(t, "tcp://127.0.0.1:0", "tcp://%s", true)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+
+	for i := 0; i < 50; i++ {
+		if peers := nodeB.GetPeers(); len(peers) == 1 && peers[0].Measured {
+			if peers[0].RTT <= 0 || peers[0].Loss != 0 {
+				t.Fatalf("unexpected measurements: %+v", peers[0])
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("link was not measured")
+}
+
+// TestCore_LinkPingFlood checks that a flood of pings is answered with a reply
+// to the newest one, rather than a reply to each.
+func TestCore_LinkPingFlood(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &linkConn{Conn: local, up: time.Now(), pings: true}
+	defer conn.Close()
+	go func() {
+		// Stands in for the router, which never gets to see the pings
+		_, _ = conn.Read(make([]byte, 65535))
+	}()
+
+	const count = 100
+	for seq := uint64(1); seq <= count; seq++ {
+		bs := binary.BigEndian.AppendUint16(nil, linkPingLength)
+		bs = append(bs, linkPingType, linkPingRequest)
+		bs = binary.BigEndian.AppendUint64(bs, seq)
+		if _, err := remote.Write(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var replies []uint64
+	reply := make([]byte, 2+linkPingLength)
+	for {
+		_ = remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := io.ReadFull(remote, reply); err != nil {
+			break
+		}
+		replies = append(replies, binary.BigEndian.Uint64(reply[4:]))
+	}
+	if len(replies) == 0 || len(replies) > 2 || replies[len(replies)-1] != count {
+		t.Fatal("unexpected replies", replies)
+	}
+}
+
+// TestCore_Handshake_Impostor checks that a node which claims a key that it
+// can't sign for is not allowed to peer.
+func TestCore_Handshake_Impostor(t *testing.T) {
+	nodeA := new(Core)
+	if err := nodeA.Start(GenerateConfig(), GetLoggerWithPrefix("A: ", true)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+
+	conn, err := net.Dial("tcp", ListenerAddr(t, nodeA).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Claim to be some other node, whose private key we don't have
+	victim, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := version_getBaseMetadata()
+	meta.key = victim
+	if err = meta.randomise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(meta.encode()); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, version_getHeaderLength())
+	if _, err = io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	var remote version_metadata
+	length, _ := remote.decodeHeader(header)
+	if _, err = io.ReadFull(conn, make([]byte, length)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(make([]byte, ed25519.SignatureSize)); err != nil {
+		t.Fatal(err)
+	}
+	// Node A should hang up on us once it has checked the signature
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatal("connection was not closed:", err)
+	}
+	if l := len(nodeA.GetPeers()); l != 0 {
+		t.Fatal("unexpected number of peers", l)
+	}
+}
+
+// TestCore_Handshake_Legacy checks that links to and from nodes running 0.4
+// are still made with its handshake, unless RejectLegacyPeers is set.
+func TestCore_Handshake_Legacy(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := version_getBaseMetadata()
+	legacy.key = pub
+	legacyBytes := legacy.encodeLegacy()
+	// Sends the metadata of a node running 0.4 to the listener, and returns the
+	// start of the metadata that comes back
+	connect := func(node *Core) version_metadata {
+		conn, err := net.Dial("tcp", ListenerAddr(t, node).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write(legacyBytes); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, len(legacyBytes))
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		var meta version_metadata
+		meta.decodePrefix(reply[:version_getPrefixLength()])
+		meta.key = reply[version_getPrefixLength():]
+		return meta
+	}
+
+	nodeA := new(Core)
+	if err = nodeA.Start(GenerateConfig(), GetLoggerWithPrefix("A: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	if meta := connect(nodeA); !meta.isLegacy() || !bytes.Equal(meta.key, nodeA.PublicKey()) {
+		t.Fatal("incoming link from 0.4 was not answered with 0.4 metadata")
+	}
+
+	// Calling a node running 0.4 fails the first time, since it sends its
+	// metadata straight away, but the peer is called with 0.4 metadata when it
+	// is retried. Over TLS, the key that 0.4 sends has been proved by the TLS
+	// handshake, so it can be called even though the key is pinned by TLS
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(crand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: priv}},
+	}
+	for _, scheme := range []string{"tcp", "tls"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		if scheme == "tls" {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		minorVers := make(chan uint8, 10)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = conn.Write(legacyBytes)
+					prefix := make([]byte, version_getPrefixLength())
+					_, _ = io.ReadFull(conn, prefix)
+					var meta version_metadata
+					meta.decodePrefix(prefix)
+					if !meta.isLegacy() {
+						// Wait for node A to give up, as 0.4 would refuse it
+						_, _ = io.Copy(io.Discard, conn)
+					}
+					minorVers <- meta.minorVer
+				}()
+			}
+		}()
+		if err = nodeA.AddPeer(scheme+"://"+listener.Addr().String(), ""); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.After(10 * time.Second)
+		var seen []uint8
+		for len(seen) == 0 || seen[len(seen)-1] != version_legacyMinorVer {
+			select {
+			case minorVer := <-minorVers:
+				seen = append(seen, minorVer)
+			case <-deadline:
+				t.Fatal("node A did not call", scheme, "with 0.4 metadata, sent minor versions", seen)
+			}
+		}
+		if seen[0] != version_getBaseMetadata().minorVer {
+			t.Fatal("node A should use the current metadata first, sent minor versions", seen)
+		}
+	}
+
+	cfg := GenerateConfig()
+	cfg.RejectLegacyPeers = true
+	nodeB := new(Core)
+	if err = nodeB.Start(cfg, GetLoggerWithPrefix("B: ", false)); err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+	if meta := connect(nodeB); meta.isLegacy() {
+		t.Fatal("incoming link from 0.4 was answered with 0.4 metadata despite RejectLegacyPeers")
+	}
 }
 
 // TestCore_Start_Transfer checks that messages can be passed between nodes (in both directions).
 func TestCore_Start_Transfer(t *testing.T) {
-	nodeA, nodeB := CreateAndConnectTwo(t, true)
+	nodeA, nodeB := CreateAndConnectTwo(t, "tcp://127.0.0.1:0", "tcp://%s", true)
 	defer nodeA.Stop()
 	defer nodeB.Stop()
 
@@ -156,7 +1863,7 @@ func TestCore_Start_Transfer(t *testing.T) {
 
 // BenchmarkCore_Start_Transfer estimates the possible transfer between nodes (in MB/s).
 func BenchmarkCore_Start_Transfer(b *testing.B) {
-	nodeA, nodeB := CreateAndConnectTwo(b, false)
+	nodeA, nodeB := CreateAndConnectTwo(b, "tcp://127.0.0.1:0", "tcp://%s", false)
 
 	msgLen := 1500 // typical MTU
 	done := CreateEchoListener(b, nodeA, msgLen, b.N)
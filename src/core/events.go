@@ -0,0 +1,103 @@
+package core
+
+// This lets applications follow what happens to links and listeners as it
+// happens, rather than polling GetPeers. Events are sent to each subscriber on
+// a buffered channel, and are dropped for any subscriber that falls behind, so
+// that a slow subscriber can't hold up the links.
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of thing that an Event reports.
+type EventType string
+
+const (
+	EventLinkUp            EventType = "link_up"            // A link finished its handshake
+	EventLinkDown          EventType = "link_down"          // A link that was up has gone down
+	EventHandshakeRejected EventType = "handshake_rejected" // A link was refused during the handshake
+	EventListenerStarted   EventType = "listener_started"
+	EventListenerStopped   EventType = "listener_stopped"
+)
+
+// Event describes something that happened to a link or a listener.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Key      ed25519.PublicKey // The remote side's key, for link events once it is known
+	LinkType string            // e.g. "tls"
+	Local    string            // The local address of a link, or the address of a listener
+	Remote   string            // Describes the remote side of a link, e.g. "tls://192.0.2.1:443"
+	Inbound  bool              // Whether the remote side opened the link
+	Err      error             // Why a link went down or was rejected, if known
+}
+
+// How many events can be waiting for a subscriber before more are dropped.
+const eventBufferSize = 64
+
+type events struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// SubscribeEvents returns a channel on which events are sent as they happen,
+// and a function that stops them and closes the channel. The channel should be
+// read promptly, since events are dropped while it is full.
+func (c *Core) SubscribeEvents() (<-chan Event, func()) {
+	e := &c.events
+	ch := make(chan Event, eventBufferSize)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.subscribers == nil {
+		e.subscribers = make(map[chan Event]struct{})
+	}
+	e.subscribers[ch] = struct{}{}
+	return ch, sync.OnceFunc(func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		delete(e.subscribers, ch)
+		close(ch)
+	})
+}
+
+// Sends an event to all of the subscribers that have room for it.
+func (e *events) publish(event Event) {
+	event.Time = time.Now()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Sends an event about a link. The key is left out if it is nil, i.e. if the
+// remote side hasn't sent one yet.
+func (intf *link) event(typ EventType, key []byte, err error) {
+	event := Event{
+		Type:     typ,
+		LinkType: intf.info.linkType,
+		Local:    intf.info.local,
+		Remote:   intf.lname,
+		Inbound:  intf.incoming,
+		Err:      err,
+	}
+	if key != nil {
+		event.Key = append(ed25519.PublicKey(nil), key...)
+	}
+	intf.links.core.events.publish(event)
+}
+
+// Sends an event about a listener.
+func (l *TcpListener) event(t *tcp, typ EventType) {
+	t.links.core.events.publish(Event{
+		Type:     typ,
+		LinkType: strings.ToLower(l.opts.linkType()),
+		Local:    l.Listener.Addr().String(),
+	})
+}
@@ -0,0 +1,180 @@
+package core
+
+// This dials peers whose names have several addresses in the way described by
+// RFC 8305 ("Happy Eyeballs v2"), so that a peer can still be reached while
+// some of its addresses, or a whole address family, can't. The addresses are
+// looked up again for every call, so that reconnecting picks up any changes to
+// DNS, and they are tried in turn, alternating between IPv6 and IPv4, with a
+// new attempt started whenever the last one fails or hasn't connected within
+// dialAttemptDelay. The first connection to succeed is used, and the rest are
+// closed.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// How long to wait for an attempt to connect before also trying the next
+// address, which is the default suggested by RFC 8305 section 5.
+const dialAttemptDelay = 250 * time.Millisecond
+
+// The resolver used to look up peers, which tests replace with their own.
+var dnsResolver = net.DefaultResolver
+
+// Looks up all of the addresses for the host and port in saddr. Link-local
+// addresses are given the zone of the interface to call from, and are skipped
+// if there isn't one.
+func (t *tcp) resolve(ctx context.Context, saddr, sintf string) ([]netip.AddrPort, error) {
+	host, portstr, err := net.SplitHostPort(saddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := dnsResolver.LookupPort(ctx, "tcp", portstr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if ips, err = dnsResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	var linkLocal bool
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.IsLinkLocalUnicast() {
+			if sintf == "" {
+				linkLocal = true
+				continue
+			}
+			ip = ip.WithZone(sintf)
+		}
+		addrs = append(addrs, netip.AddrPortFrom(ip, uint16(port)))
+	}
+	if len(addrs) == 0 {
+		if linkLocal {
+			return nil, errors.New("link-local address requires an interface")
+		}
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return interleaveAddresses(addrs), nil
+}
+
+// Orders addresses to alternate between address families, starting with the
+// family of the first, and otherwise keeping the order that the resolver
+// preferred, as described in RFC 8305 section 4.
+func interleaveAddresses(addrs []netip.AddrPort) []netip.AddrPort {
+	var first, second []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]netip.AddrPort, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ordered, first = append(ordered, first[0]), first[1:]
+		}
+		if len(second) > 0 {
+			ordered, second = append(ordered, second[0]), second[1:]
+		}
+	}
+	return ordered
+}
+
+// Races connection attempts to the addresses in order, starting each one once
+// the last has failed or after the delay, and returns the first connection to
+// succeed along with the address that it connected to. A delay of 0 means that
+// only one attempt is made at a time. If they all fail then the error says why
+// each one did.
+func dialAddresses(ctx context.Context, addrs []netip.AddrPort, delay time.Duration, dial func(ctx context.Context, addr netip.AddrPort) (net.Conn, error)) (net.Conn, netip.AddrPort, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		addr netip.AddrPort
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var next, pending int
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, addr, err}
+		}()
+	}
+	start()
+	var errs []error
+	for pending > 0 {
+		var timeout <-chan time.Time
+		if next < len(addrs) && delay > 0 {
+			timeout = time.After(delay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Any attempts that are still going are cancelled when this
+				// returns, but may have connected already
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.addr, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.addr, r.err))
+			if next < len(addrs) {
+				start()
+			}
+		case <-timeout:
+			start()
+		}
+	}
+	return nil, netip.AddrPort{}, errors.Join(errs...)
+}
+
+// Picks the address of the interface to call from when connecting to dst, so
+// that the connection stays on that interface.
+func interfaceSource(addrs []net.Addr, sintf string, dst net.IP) *net.TCPAddr {
+	for addrindex, addr := range addrs {
+		src, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
+		if src.Equal(dst) {
+			continue
+		}
+		if !src.IsGlobalUnicast() && !src.IsLinkLocalUnicast() {
+			continue
+		}
+		bothglobal := src.IsGlobalUnicast() == dst.IsGlobalUnicast()
+		bothlinklocal := src.IsLinkLocalUnicast() == dst.IsLinkLocalUnicast()
+		if !bothglobal && !bothlinklocal {
+			continue
+		}
+		if (src.To4() != nil) != (dst.To4() != nil) {
+			continue
+		}
+		if bothglobal || bothlinklocal || addrindex == len(addrs)-1 {
+			return &net.TCPAddr{
+				IP:   src,
+				Port: 0,
+				Zone: sintf,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package core
+
+// This adds dialing through HTTP proxies that support the CONNECT method, for
+// networks where that is the only way out. Peer URIs take the form
+// http-proxy://[user:pass@]proxyhost:port/peerhost:port, in the same way as
+// socks:// peers, and the link is upgraded to TLS unless ?tls=false is given.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// bufferedConn is a net.Conn that first reads anything that was buffered while
+// reading the proxy's response, since the remote node may already have started
+// sending.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Connects to the HTTP proxy and asks it to open a tunnel to the given address.
+func (t *tcp) dialHTTPProxy(ctx context.Context, saddr string, options *tcpOptions) (net.Conn, error) {
+	dialer := net.Dialer{
+		Control:         t.tcpContext,
+		KeepAliveConfig: t.keepAliveConfig(),
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", options.httpProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: saddr},
+		Host:   saddr,
+		Header: make(http.Header),
+	}
+	if auth := options.httpProxyAuth; auth != nil {
+		password, _ := auth.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	// Give up on the proxy if the context ends before it has answered
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused to connect to %s: %s", saddr, res.Status)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	options.proxyPeerAddr = saddr
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
@@ -1,13 +1,17 @@
 package core
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -18,19 +22,40 @@ import (
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	"github.com/yggdrasil-network/yggdrasil-go/src/util"
-	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
 	//"github.com/Arceliar/phony" // TODO? use instead of mutexes
 )
 
 type links struct {
-	core    *Core
-	mutex   sync.RWMutex // protects links below
-	links   map[linkInfo]*link
-	tcp     tcp // TCP interface support
-	stopped chan struct{}
-	// TODO timeout (to remove from switch), read from config.ReadTimeout
+	core             *Core
+	mutex            sync.RWMutex // protects links below
+	links            map[linkInfo]*link
+	legacyPeers      map[string]struct{} // Peer URIs that were found to be running 0.4, to call with its handshake next time
+	tcp              tcp                 // TCP interface support
+	stopped          chan struct{}
+	keepAlive        time.Duration // How long a link can be idle before we send a keepalive, from config.KeepAliveInterval
+	readTimeout      time.Duration // How long to wait to hear from a peer before dropping the link, from config.ReadTimeout
+	handshakeTimeout time.Duration // How long a new link has to finish the handshake, from config.HandshakeTimeout
+	maxRXRate        uint64        // Total receive rate limit for all links in bytes per second, from config.MaxRXRate
+	maxTXRate        uint64        // Total transmit rate limit for all links in bytes per second, from config.MaxTXRate
+	rxLimiter        *rate.Limiter // Shared by all links, nil if there is no total receive rate limit
+	txLimiter        *rate.Limiter // Shared by all links, nil if there is no total transmit rate limit
+	rejectLegacy     bool          // Whether links from nodes running 0.4 are refused, from config.RejectLegacyPeers
 }
 
+// The defaults for the link timeouts, which match those that the router uses
+// internally. The router sends its own keepalive whenever it has sent nothing
+// for linkKeepAliveDefault, so ours are only needed to keep a link alive for
+// shorter read timeouts than linkReadTimeoutDefault.
+const (
+	linkKeepAliveDefault   = 4 * time.Second
+	linkReadTimeoutDefault = 6 * time.Second
+)
+
+// A keepalive is an empty "dummy" packet in the router's wire format, which the
+// remote side reads and throws away, so it works with any version.
+var linkKeepAliveMessage = []byte{0x00, 0x01, 0x00}
+
 // linkInfo is used as a map key
 type linkInfo struct {
 	key      keyArray
@@ -41,6 +66,7 @@ type linkInfo struct {
 
 type link struct {
 	lname    string
+	addr     string // The address that was dialed, for outgoing links
 	links    *links
 	conn     *linkConn
 	options  linkOptions
@@ -48,19 +74,62 @@ type link struct {
 	incoming bool
 	force    bool
 	closed   chan struct{}
+	// The minor version and optional features negotiated with the remote side
+	minorVer      uint8
+	capabilities  version_capabilities
+	deadline      time.Time // When the handshake must be finished by
+	handshakeDone func()    // Called once the handshake is finished, if set
 }
 
 type linkOptions struct {
 	pinnedEd25519Keys map[keyArray]struct{}
+	keyVerified       bool        // Whether TLS proved that the remote side owns one of the pinned keys
+	peer              string      // The peer URI that was called, for outgoing links
+	sintf             string      // The source interface that the peer was called on
+	name              string      // A name for the link from ?name=, for people to recognise it by
+	tags              []string    // Labels for the link from ?tags=, for grouping and filtering peers
+	maxRXRate         uint64      // Receive rate limit in bytes per second, 0 for no limit
+	maxTXRate         uint64      // Transmit rate limit in bytes per second, 0 for no limit
+	onConnected       func()      // Called once the handshake has succeeded, for outgoing links
+	onDisconnected    func(error) // Called with the reason once an outgoing call is over
 }
 
 func (l *links) init(c *Core) error {
 	l.core = c
 	l.mutex.Lock()
 	l.links = make(map[linkInfo]*link)
+	l.legacyPeers = make(map[string]struct{})
 	l.mutex.Unlock()
 	l.stopped = make(chan struct{})
 
+	c.config.RLock()
+	l.keepAlive = time.Duration(c.config.KeepAliveInterval) * time.Second
+	l.readTimeout = time.Duration(c.config.ReadTimeout) * time.Second
+	l.handshakeTimeout = time.Duration(c.config.HandshakeTimeout) * time.Second
+	l.maxRXRate, l.maxTXRate = c.config.MaxRXRate, c.config.MaxTXRate
+	l.rejectLegacy = c.config.RejectLegacyPeers
+	c.config.RUnlock()
+	if l.keepAlive == 0 {
+		l.keepAlive = linkKeepAliveDefault
+	}
+	if l.readTimeout == 0 {
+		l.readTimeout = linkReadTimeoutDefault
+	}
+	if l.handshakeTimeout == 0 {
+		l.handshakeTimeout = acceptHandshakeTimeoutDefault
+	}
+	if l.readTimeout <= l.keepAlive {
+		c.log.Warnf("ReadTimeout (%s) should be longer than KeepAliveInterval (%s), otherwise idle links will be dropped", l.readTimeout, l.keepAlive)
+	}
+
+	if l.maxRXRate > 0 {
+		l.rxLimiter = newLinkLimiter(l.maxRXRate)
+	}
+	if l.maxTXRate > 0 {
+		l.txLimiter = newLinkLimiter(l.maxTXRate)
+	}
+	go l.measureRates()
+
 	if err := l.tcp.init(l); err != nil {
 		c.log.Errorln("Failed to start TCP interface")
 		return err
@@ -69,12 +138,29 @@ func (l *links) init(c *Core) error {
 	return nil
 }
 
-func (l *links) call(u *url.URL, sintf string) error {
+func (l *links) call(u *url.URL, sintf string, options linkOptions) error {
 	//u, err := url.Parse(uri)
 	//if err != nil {
 	//	return fmt.Errorf("peer %s is not correctly formatted (%s)", uri, err)
 	//}
-	tcpOpts := tcpOptions{}
+	tcpOpts := tcpOptions{linkOptions: options}
+	if err := tcpOpts.setQueryOptions(u.Query()); err != nil {
+		return fmt.Errorf("peer %s is not correctly formatted (%s)", u.String(), err)
+	}
+	tcpOpts.peer = u.String()
+	tcpOpts.sintf = sintf
+	if source := u.Query().Get("source"); source != "" {
+		var err error
+		switch {
+		case u.Scheme != "tcp" && u.Scheme != "tls" && u.Scheme != "obfs":
+			return fmt.Errorf("peer %s is not correctly formatted (source is only supported on tcp://, tls:// and obfs:// peers)", u.String())
+		case sintf != "":
+			return fmt.Errorf("peer %s is not correctly formatted (source can't be used with a source interface)", u.String())
+		}
+		if tcpOpts.source, err = parseSource(source); err != nil {
+			return fmt.Errorf("peer %s is not correctly formatted (%s)", u.String(), err)
+		}
+	}
 	if pubkeys, ok := u.Query()["key"]; ok && len(pubkeys) > 0 {
 		tcpOpts.pinnedEd25519Keys = make(map[keyArray]struct{})
 		for _, pubkey := range pubkeys {
@@ -85,51 +171,115 @@ func (l *links) call(u *url.URL, sintf string) error {
 			}
 		}
 	}
-	switch u.Scheme {
-	case "tcp":
-		l.tcp.call(u.Host, tcpOpts, sintf)
-	case "socks":
-		tcpOpts.socksProxyAddr = u.Host
-		if u.User != nil {
-			tcpOpts.socksProxyAuth = &proxy.Auth{}
-			tcpOpts.socksProxyAuth.User = u.User.Username()
-			tcpOpts.socksProxyAuth.Password, _ = u.User.Password()
-		}
-		tcpOpts.upgrade = l.tcp.tls.forDialer // TODO make this configurable
-		pathtokens := strings.Split(strings.Trim(u.Path, "/"), "/")
-		l.tcp.call(pathtokens[0], tcpOpts, sintf)
-	case "tls":
-		tcpOpts.upgrade = l.tcp.tls.forDialer
-		// SNI headers must contain hostnames and not IP addresses, so we must make sure
-		// that we do not populate the SNI with an IP literal. We do this by splitting
-		// the host-port combo from the query option and then seeing if it parses to an
-		// IP address successfully or not.
-		if sni := u.Query().Get("sni"); sni != "" {
-			if net.ParseIP(sni) == nil {
-				tcpOpts.tlsSNI = sni
+	return l.callTransport(u, tcpOpts, sintf)
+}
+
+// Sets the options that can be given in the query string of both peer and
+// listener URIs:
+//
+//	maxrate    limits both the receive and transmit rates of each link
+//	maxrxrate  limits the receive rate of each link
+//	maxtxrate  limits the transmit rate of each link
+//
+// Rates are in bytes per second, see parseRate.
+func (o *linkOptions) setQueryOptions(query url.Values) error {
+	var err error
+	o.name = query.Get("name")
+	for _, tags := range query["tags"] {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(o.tags, tag) {
+				o.tags = append(o.tags, tag)
 			}
 		}
-		// If the SNI is not configured still because the above failed then we'll try
-		// again but this time we'll use the host part of the peering URI instead.
-		if tcpOpts.tlsSNI == "" {
-			if host, _, err := net.SplitHostPort(u.Host); err == nil && net.ParseIP(host) == nil {
-				tcpOpts.tlsSNI = host
-			}
+	}
+	if s := query.Get("maxrate"); s != "" {
+		if o.maxRXRate, err = parseRate(s); err != nil {
+			return err
+		}
+		o.maxTXRate = o.maxRXRate
+	}
+	if s := query.Get("maxrxrate"); s != "" {
+		if o.maxRXRate, err = parseRate(s); err != nil {
+			return err
+		}
+	}
+	if s := query.Get("maxtxrate"); s != "" {
+		if o.maxTXRate, err = parseRate(s); err != nil {
+			return err
 		}
-		l.tcp.call(u.Host, tcpOpts, sintf)
-	default:
-		return errors.New("unknown call scheme: " + u.Scheme)
 	}
 	return nil
 }
 
+// Describes the link by its name and tags for the logs, e.g. "backbone-1
+// [transit,eu]", or returns "" if it has neither.
+func (o *linkOptions) label() string {
+	label := o.name
+	if len(o.tags) > 0 {
+		label = strings.TrimSpace(label + " [" + strings.Join(o.tags, ",") + "]")
+	}
+	return label
+}
+
+// Parses a rate in bytes per second, with an optional k, M or G suffix for
+// thousands, millions or billions, e.g. "500k" or "10M".
+func parseRate(s string) (uint64, error) {
+	mult := uint64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult = 1e3
+	case 'M':
+		mult = 1e6
+	case 'G':
+		mult = 1e9
+	}
+	digits := s
+	if mult > 1 {
+		digits = s[:len(s)-1]
+	}
+	rate, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || rate == 0 || rate > math.MaxUint64/mult {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate * mult, nil
+}
+
+// Closes any links that were made by calling the given peer URI on the given
+// source interface.
+func (l *links) closeCalled(u *url.URL, sintf string) {
+	peer := u.String()
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, intf := range l.links {
+		if !intf.incoming && intf.options.peer == peer && intf.options.sintf == sintf {
+			intf.close()
+		}
+	}
+}
+
 func (l *links) create(conn net.Conn, name, linkType, local, remote string, incoming, force bool, options linkOptions) (*link, error) {
 	// Technically anything unique would work for names, but let's pick something human readable, just for debugging
+	lc := &linkConn{
+		Conn:      conn,
+		up:        time.Now(),
+		maxRXRate: minRate(options.maxRXRate, l.maxRXRate),
+		maxTXRate: minRate(options.maxTXRate, l.maxTXRate),
+	}
+	lc.ctx, lc.cancel = context.WithCancel(l.core.ctx)
+	if options.maxRXRate > 0 {
+		lc.rxLimiters = append(lc.rxLimiters, newLinkLimiter(options.maxRXRate))
+	}
+	if l.rxLimiter != nil {
+		lc.rxLimiters = append(lc.rxLimiters, l.rxLimiter)
+	}
+	if options.maxTXRate > 0 {
+		lc.txLimiters = append(lc.txLimiters, newLinkLimiter(options.maxTXRate))
+	}
+	if l.txLimiter != nil {
+		lc.txLimiters = append(lc.txLimiters, l.txLimiter)
+	}
 	intf := link{
-		conn: &linkConn{
-			Conn: conn,
-			up:   time.Now(),
-		},
+		conn:    lc,
 		lname:   name,
 		links:   l,
 		options: options,
@@ -144,6 +294,25 @@ func (l *links) create(conn net.Conn, name, linkType, local, remote string, inco
 	return &intf, nil
 }
 
+// Updates the current rates of all links once per second, until the links are
+// stopped.
+func (l *links) measureRates() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopped:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.RLock()
+		for _, intf := range l.links {
+			intf.conn.updateRates()
+		}
+		l.mutex.RUnlock()
+	}
+}
+
 func (l *links) stop() error {
 	close(l.stopped)
 	if err := l.tcp.stop(); err != nil {
@@ -155,41 +324,40 @@ func (l *links) stop() error {
 func (intf *link) handler() (chan struct{}, error) {
 	// TODO split some of this into shorter functions, so it's easier to read, and for the FIXME duplicate peer issue mentioned later
 	defer intf.conn.Close()
-	meta := version_getBaseMetadata()
-	meta.key = intf.links.core.public
-	metaBytes := meta.encode()
-	// TODO timeouts on send/recv (goroutine for send/recv, channel select w/ timer)
-	var err error
-	if !util.FuncTimeout(30*time.Second, func() {
-		var n int
-		n, err = intf.conn.Write(metaBytes)
-		if err == nil && n != len(metaBytes) {
-			err = errors.New("incomplete metadata send")
-		}
-	}) {
-		return nil, errors.New("timeout on metadata send")
+	if intf.deadline.IsZero() {
+		intf.deadline = time.Now().Add(intf.links.handshakeTimeout)
 	}
-	if err != nil {
+	base := version_getBaseMetadata()
+	base.key = intf.links.core.public
+	base.readTimeout = uint32(intf.links.readTimeout.Milliseconds())
+	if err := base.randomise(); err != nil {
 		return nil, err
 	}
-	if !util.FuncTimeout(30*time.Second, func() {
-		var n int
-		n, err = io.ReadFull(intf.conn, metaBytes)
-		if err == nil && n != len(metaBytes) {
-			err = errors.New("incomplete metadata recv")
+	// Nodes running 0.4 send their metadata as soon as they connect and refuse
+	// anything newer, so while they are accepted, incoming links wait to see
+	// which version the remote side is running and answer in kind. Outgoing
+	// links can't tell until it's too late, so they only send 0.4 metadata if
+	// the last call to the same peer found that it was running 0.4
+	acceptLegacy := intf.acceptLegacy()
+	sendFirst := !intf.incoming || !acceptLegacy
+	sentLegacy := sendFirst && acceptLegacy && intf.links.takeLegacyPeer(intf.options.peer)
+	if sendFirst {
+		if err := intf.sendMetadata(&base, sentLegacy); err != nil {
+			return nil, err
 		}
-	}) {
-		return nil, errors.New("timeout on metadata recv")
 	}
-	if err != nil {
+	// Read the version numbers first, so that we can give up early if the
+	// remote side is running a version that we don't understand the rest of
+	headerBytes := make([]byte, version_getHeaderLength())
+	prefixBytes := headerBytes[:version_getPrefixLength()]
+	if err := intf.recv(prefixBytes, "metadata"); err != nil {
 		return nil, err
 	}
-	meta = version_metadata{}
-	base := version_getBaseMetadata()
-	if !meta.decode(metaBytes) {
+	meta := version_metadata{}
+	if !meta.decodePrefix(prefixBytes) {
 		return nil, errors.New("failed to decode metadata")
 	}
-	if !meta.check() {
+	incompatible := func() (chan struct{}, error) {
 		var connectError string
 		if intf.incoming {
 			connectError = "Rejected incoming connection"
@@ -199,19 +367,84 @@ func (intf *link) handler() (chan struct{}, error) {
 		intf.links.core.log.Debugf("%s: %s is incompatible version (local %s, remote %s)",
 			connectError,
 			intf.lname,
-			fmt.Sprintf("%d.%d", base.ver, base.minorVer),
-			fmt.Sprintf("%d.%d", meta.ver, meta.minorVer),
+			base.version(),
+			meta.version(),
 		)
-		return nil, errors.New("remote node is incompatible version")
+		err := errors.New("remote node is incompatible version")
+		intf.event(EventHandshakeRejected, nil, err)
+		return nil, err
+	}
+	legacy := meta.isLegacy()
+	switch {
+	case legacy && !acceptLegacy:
+		return incompatible()
+	case legacy && sendFirst && !sentLegacy:
+		// The remote side will refuse the metadata that we already sent
+		intf.links.addLegacyPeer(intf.options.peer)
+		intf.links.core.log.Infof("Failed to connect: %s is running version %s, will call it with the old handshake next time",
+			intf.lname, meta.version())
+		return nil, errors.New("remote node is running an old version")
+	case legacy:
+		key := make([]byte, ed25519.PublicKeySize)
+		if err := intf.recv(key, "metadata"); err != nil {
+			return nil, err
+		}
+		meta.key = key
+	case sentLegacy:
+		return incompatible()
+	default:
+		if err := intf.recv(headerBytes[len(prefixBytes):], "metadata"); err != nil {
+			return nil, err
+		}
+		length, _ := meta.decodeHeader(headerBytes)
+		if !meta.checkHeader() {
+			return incompatible()
+		}
+		metaBytes := make([]byte, length)
+		if err := intf.recv(metaBytes, "metadata"); err != nil {
+			return nil, err
+		}
+		if !meta.decode(metaBytes) {
+			return nil, errors.New("failed to decode metadata")
+		}
+		if !meta.check() {
+			return incompatible()
+		}
 	}
-	// Check if the remote side matches the keys we expected. This is a bit of a weak
-	// check - in future versions we really should check a signature or something like that.
+	if !sendFirst {
+		if err := intf.sendMetadata(&base, legacy); err != nil {
+			return nil, err
+		}
+	}
+	intf.minorVer, intf.capabilities = base.negotiate(&meta)
+	// Prove that we own our key by signing the remote side's nonce, and check
+	// that the remote side can do the same for ours. Until this is done, the
+	// key that the remote side sent is just a claim, which it stays for nodes
+	// running 0.4, since they can't sign anything
+	if !legacy {
+		if err := intf.send(base.sign(intf.links.core.secret, &meta), "signature"); err != nil {
+			return nil, err
+		}
+		sig := make([]byte, ed25519.SignatureSize)
+		if err := intf.recv(sig, "signature"); err != nil {
+			return nil, err
+		}
+		if !base.verify(&meta, sig) {
+			intf.links.core.log.Errorf("Failed to connect to node: %q sent a signature that does not match its ed25519 key", intf.name())
+			err := errors.New("failed to connect: host sent an invalid signature for its ed25519 key")
+			intf.event(EventHandshakeRejected, nil, err)
+			return nil, err
+		}
+	}
+	// Check if the remote side matches the keys we expected
 	if pinned := intf.options.pinnedEd25519Keys; pinned != nil {
 		var key keyArray
 		copy(key[:], meta.key)
 		if _, allowed := pinned[key]; !allowed {
 			intf.links.core.log.Errorf("Failed to connect to node: %q sent ed25519 key that does not match pinned keys", intf.name())
-			return nil, fmt.Errorf("failed to connect: host sent ed25519 key that does not match pinned keys")
+			err := errors.New("failed to connect: host sent ed25519 key that does not match pinned keys")
+			intf.event(EventHandshakeRejected, meta.key, err)
+			return nil, err
 		}
 	}
 	// Check if we're authorized to connect to this key / IP
@@ -228,9 +461,13 @@ func (intf *link) handler() (chan struct{}, error) {
 	if intf.incoming && !intf.force && !isallowed {
 		intf.links.core.log.Warnf("%s connection from %s forbidden: AllowedEncryptionPublicKeys does not contain key %s",
 			strings.ToUpper(intf.info.linkType), intf.info.remote, hex.EncodeToString(meta.key))
+		intf.event(EventHandshakeRejected, meta.key, errors.New("key is not in AllowedPublicKeys"))
 		intf.close()
 		return nil, nil
 	}
+	if intf.handshakeDone != nil {
+		intf.handshakeDone()
+	}
 	// Check if we already have a link to this node
 	copy(intf.info.key[:], meta.key)
 	intf.links.mutex.Lock()
@@ -239,6 +476,9 @@ func (intf *link) handler() (chan struct{}, error) {
 		// FIXME we should really return an error and let the caller block instead
 		// That lets them do things like close connections on its own, avoid printing a connection message in the first place, etc.
 		intf.links.core.log.Debugln("DEBUG: found existing interface for", intf.name())
+		if intf.options.onConnected != nil {
+			intf.options.onConnected()
+		}
 		return oldIntf.closed, nil
 	} else {
 		intf.closed = make(chan struct{})
@@ -255,10 +495,22 @@ func (intf *link) handler() (chan struct{}, error) {
 	themAddr := address.AddrForKey(ed25519.PublicKey(intf.info.key[:]))
 	themAddrString := net.IP(themAddr[:]).String()
 	themString := fmt.Sprintf("%s@%s", themAddrString, intf.info.remote)
-	intf.links.core.log.Infof("Connected %s: %s, source %s",
-		strings.ToUpper(intf.info.linkType), themString, intf.info.local)
+	if label := intf.options.label(); label != "" {
+		themString += " (" + label + ")"
+	}
+	intf.links.core.log.Infof("Connected %s: %s, source %s, version %d.%d, capabilities: %s",
+		strings.ToUpper(intf.info.linkType), themString, intf.info.local,
+		base.ver, intf.minorVer, intf.capabilities)
+	intf.event(EventLinkUp, intf.info.key[:], nil)
+	if intf.options.onConnected != nil {
+		intf.options.onConnected()
+	}
 	// Run the handler
-	err = intf.links.core.HandleConn(ed25519.PublicKey(intf.info.key[:]), intf.conn)
+	intf.conn.startKeepAlive(intf.keepAliveTimes(&meta))
+	if intf.capabilities.has(version_capPing) {
+		intf.conn.startPings()
+	}
+	err := intf.links.core.HandleConn(ed25519.PublicKey(intf.info.key[:]), intf.conn)
 	// TODO don't report an error if it's just a 'use of closed network connection'
 	if err != nil {
 		intf.links.core.log.Infof("Disconnected %s: %s, source %s; error: %s",
@@ -267,9 +519,108 @@ func (intf *link) handler() (chan struct{}, error) {
 		intf.links.core.log.Infof("Disconnected %s: %s, source %s",
 			strings.ToUpper(intf.info.linkType), themString, intf.info.local)
 	}
+	intf.event(EventLinkDown, intf.info.key[:], err)
 	return nil, err
 }
 
+// Works out how often keepalives need to be sent on the link, or 0 if the
+// router's own are often enough, and how long to wait to hear from the remote
+// side before dropping it. Both sides send the read timeout that they use, and
+// if they negotiated the keepalive capability then each sends keepalives often
+// enough for the other's, at the same ratio as the router's defaults. Otherwise
+// the remote side only keeps the link alive as often as the router does, so
+// the read timeout isn't allowed to be any shorter than the router's.
+func (intf *link) keepAliveTimes(remote *version_metadata) (interval, timeout time.Duration) {
+	interval, timeout = intf.links.keepAlive, intf.links.readTimeout
+	if intf.capabilities.has(version_capKeepAlive) && remote.readTimeout != 0 {
+		remoteTimeout := time.Duration(remote.readTimeout) * time.Millisecond
+		interval = min(interval, remoteTimeout*2/3) // As with linkKeepAliveDefault and linkReadTimeoutDefault
+	} else {
+		timeout = max(timeout, linkReadTimeoutDefault)
+	}
+	if interval >= linkKeepAliveDefault {
+		interval = 0
+	}
+	return interval, timeout
+}
+
+// Checks whether the link can be made with a node running 0.4, which can't prove
+// that it owns the key that it sends. That's only allowed if the key doesn't
+// need to be checked, i.e. if there are no pinned keys that TLS hasn't already
+// proved and, for incoming links, AllowedPublicKeys doesn't apply, and if
+// config.RejectLegacyPeers isn't set. The key that 0.4 sends is still checked
+// against the pinned keys, so over TLS it must be the one that was proved.
+func (intf *link) acceptLegacy() bool {
+	if intf.links.rejectLegacy || (intf.options.pinnedEd25519Keys != nil && !intf.options.keyVerified) {
+		return false
+	}
+	if !intf.incoming || intf.force {
+		return true
+	}
+	intf.links.core.config.RLock()
+	defer intf.links.core.config.RUnlock()
+	return len(intf.links.core.config.AllowedPublicKeys) == 0
+}
+
+// Sends our metadata, in the format of 0.4 if legacy is set.
+func (intf *link) sendMetadata(base *version_metadata, legacy bool) error {
+	if legacy {
+		return intf.send(base.encodeLegacy(), "metadata")
+	}
+	return intf.send(base.encode(), "metadata")
+}
+
+// Remembers that calling the peer URI found a node running 0.4.
+func (l *links) addLegacyPeer(peer string) {
+	if peer == "" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.legacyPeers[peer] = struct{}{}
+}
+
+// Checks whether the peer URI should be called with the 0.4 handshake, which
+// is only done once after it was found to be running 0.4, so that the link
+// goes back to the current handshake once the peer has been upgraded.
+func (l *links) takeLegacyPeer(peer string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.legacyPeers[peer]
+	delete(l.legacyPeers, peer)
+	return ok
+}
+
+// Sends bs in full on the link, giving up if the handshake deadline passes.
+func (intf *link) send(bs []byte, what string) error {
+	var err error
+	if !util.FuncTimeout(time.Until(intf.deadline), func() {
+		var n int
+		n, err = intf.conn.Write(bs)
+		if err == nil && n != len(bs) {
+			err = errors.New("incomplete " + what + " send")
+		}
+	}) {
+		return handshakeTimeoutError(what + " send")
+	}
+	return err
+}
+
+// Fills bs from the link, giving up if the handshake deadline passes.
+func (intf *link) recv(bs []byte, what string) error {
+	var err error
+	if !util.FuncTimeout(time.Until(intf.deadline), func() {
+		var n int
+		n, err = io.ReadFull(intf.conn, bs)
+		if err == nil && n != len(bs) {
+			err = errors.New("incomplete " + what + " recv")
+		}
+	}) {
+		return handshakeTimeoutError(what + " recv")
+	}
+	return err
+}
+
 func (intf *link) close() {
 	intf.conn.Close()
 }
@@ -281,20 +632,184 @@ func (intf *link) name() string {
 type linkConn struct {
 	// tx and rx are at the beginning of the struct to ensure 64-bit alignment
 	// on 32-bit platforms, see https://pkg.go.dev/sync/atomic#pkg-note-BUG
-	rx uint64
-	tx uint64
-	up time.Time
+	rx     uint64
+	tx     uint64
+	rxRate uint64 // Bytes received in the last second
+	txRate uint64 // Bytes sent in the last second
+	rxLast uint64 // Only used by updateRates
+	txLast uint64 // Only used by updateRates
+	up     time.Time
 	net.Conn
+	readTimeout time.Duration   // If set, replaces the read deadlines that the router sets
+	maxRXRate   uint64          // The lowest receive rate limit that applies, 0 if none
+	maxTXRate   uint64          // The lowest transmit rate limit that applies, 0 if none
+	rxLimiters  []*rate.Limiter // The per-link and total receive rate limits, if any
+	txLimiters  []*rate.Limiter // The per-link and total transmit rate limits, if any
+	ctx         context.Context // Cancelled when the connection is closed, to stop waiting for the rate limits
+	cancel      context.CancelFunc
+	wmutex      sync.Mutex  // Stops keepalives from being written in the middle of a packet
+	lastWrite   time.Time   // Protected by wmutex
+	keepAlive   *time.Timer // Protected by wmutex
+	closed      bool        // Protected by wmutex
+	pings       bool        // Whether pings are taken out of the stream, set before the router starts reading
+	readBuf     []byte      // The rest of the packet that the router is reading, if pings is set
+	packetBuf   []byte      // Holds each packet that is read, if pings is set
+	pmutex      sync.Mutex  // Protects the ping state below
+	pingTimer   *time.Timer
+	pingSeq     uint64
+	pingSent    time.Time // When the outstanding ping was sent, zero if there isn't one
+	pingStopped bool
+	replySeq    uint64 // The sequence number of the newest ping from the remote side
+	replyDue    bool   // Whether it still needs a reply
+	replying    bool   // Whether a goroutine is sending replies
+	stats       linkStats
+	measured    bool // Whether there have been any replies yet
+}
+
+// The most that a link reads or writes at once when it is rate limited, and the
+// smallest burst that the rate limits allow, which is enough for the largest
+// packet that the router sends.
+const linkRateBurst = 65535 + 2
+
+// Creates a rate limiter for the given rate in bytes per second.
+func newLinkLimiter(r uint64) *rate.Limiter {
+	burst := linkRateBurst
+	if r > linkRateBurst && r < math.MaxInt32 {
+		burst = int(r)
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+// Gets the lower of two rate limits, where 0 means no limit.
+func minRate(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Starts sending keepalives whenever nothing has been written for the given
+// interval, if it isn't 0, and makes reads time out if nothing has been
+// received for the given timeout. This must only be called once the handshake
+// is done, since the keepalives are in the router's wire format.
+func (c *linkConn) startKeepAlive(interval, timeout time.Duration) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.readTimeout = timeout
+	if c.closed || interval == 0 {
+		return
+	}
+	c.lastWrite = time.Now()
+	var keepAlive func()
+	keepAlive = func() {
+		c.wmutex.Lock()
+		defer c.wmutex.Unlock()
+		if c.closed {
+			return
+		}
+		if idle := time.Since(c.lastWrite); idle < interval {
+			c.keepAlive = time.AfterFunc(interval-idle, keepAlive)
+			return
+		}
+		if _, err := c._write(linkKeepAliveMessage); err != nil {
+			return
+		}
+		c.keepAlive = time.AfterFunc(interval, keepAlive)
+	}
+	c.keepAlive = time.AfterFunc(interval, keepAlive)
 }
 
 func (c *linkConn) Read(p []byte) (n int, err error) {
+	if c.pings {
+		return c.readPackets(p)
+	}
+	return c.read(p)
+}
+
+// Reads from the connection, subject to the rate limits.
+func (c *linkConn) read(p []byte) (n int, err error) {
+	if len(c.rxLimiters) > 0 && len(p) > linkRateBurst {
+		p = p[:linkRateBurst]
+	}
 	n, err = c.Conn.Read(p)
 	atomic.AddUint64(&c.rx, uint64(n))
+	if werr := c.wait(c.rxLimiters, n); err == nil {
+		err = werr
+	}
 	return
 }
 
 func (c *linkConn) Write(p []byte) (n int, err error) {
-	n, err = c.Conn.Write(p)
-	atomic.AddUint64(&c.tx, uint64(n))
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return c._write(p)
+}
+
+// Writes p, the caller must hold wmutex.
+func (c *linkConn) _write(p []byte) (n int, err error) {
+	defer func() {
+		c.lastWrite = time.Now()
+	}()
+	for len(p) > 0 {
+		chunk := p
+		if len(c.txLimiters) > 0 && len(chunk) > linkRateBurst {
+			chunk = chunk[:linkRateBurst]
+		}
+		if err = c.wait(c.txLimiters, len(chunk)); err != nil {
+			return
+		}
+		var m int
+		m, err = c.Conn.Write(chunk)
+		n += m
+		atomic.AddUint64(&c.tx, uint64(m))
+		if err != nil {
+			return
+		}
+		p = p[m:]
+	}
 	return
 }
+
+// Waits until the rate limits allow n more bytes to be sent or received.
+func (c *linkConn) wait(limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		if err := limiter.WaitN(c.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Works out how many bytes were sent and received since the last update.
+func (c *linkConn) updateRates() {
+	rx, tx := atomic.LoadUint64(&c.rx), atomic.LoadUint64(&c.tx)
+	atomic.StoreUint64(&c.rxRate, rx-c.rxLast)
+	atomic.StoreUint64(&c.txRate, tx-c.txLast)
+	c.rxLast, c.txLast = rx, tx
+}
+
+// The router sets its own read deadline before each read, which we replace with
+// one based on the configured read timeout.
+func (c *linkConn) SetReadDeadline(t time.Time) error {
+	if c.readTimeout > 0 && !t.IsZero() {
+		t = time.Now().Add(c.readTimeout)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Closes the connection first, which unblocks any read or write that is in
+// progress or waiting for the rate limits, and then stops sending keepalives.
+func (c *linkConn) Close() error {
+	err := c.Conn.Close()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.closed = true
+	if c.keepAlive != nil {
+		c.keepAlive.Stop()
+	}
+	c.stopPings()
+	return err
+}
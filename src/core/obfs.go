@@ -0,0 +1,253 @@
+package core
+
+// This adds obfs:// links, which look like random bytes to anyone watching, so
+// that they can't be picked out by the plaintext metadata that starts every
+// other kind of link. The peer URI must pin the listener's key, e.g.
+// obfs://a.b.c.d:e?key=..., since the keys for each connection are derived
+// from it together with random salts, and anyone without it sees nothing but
+// random salts and ciphertext. Every frame is padded by a random amount, and
+// the first frames from each side are only padding, so that neither the sizes
+// of the packets nor the length of the handshake give the link away. A
+// listener that is sent anything else, e.g. by a censor probing it, reads
+// until the handshake times out without ever replying. The link handshake and
+// the router's stream run over the top unchanged.
+//
+// Note that the key is only as secret as the peer URI, so this hides links
+// from observers rather than authenticating them. The link handshake still
+// checks that the listener owns its key as usual.
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	obfsSaltLength          = 32
+	obfsHeaderLength        = 2 + 2 // Payload length and padding length
+	obfsMaxPayload          = 16384
+	obfsMaxPadding          = 256  // The most padding added to each frame
+	obfsMaxHandshakePadding = 1024 // The most padding sent before anything else
+	obfsReplayWindow        = 10 * time.Minute
+)
+
+var (
+	obfsClientInfo = []byte("yggdrasil obfs client")
+	obfsServerInfo = []byte("yggdrasil obfs server")
+)
+
+type tcpobfs struct {
+	tcp         *tcp
+	forDialer   *TcpUpgrade
+	forListener *TcpUpgrade
+	mutex       sync.Mutex // Protects seen
+	seen        map[[obfsSaltLength]byte]time.Time
+}
+
+func (o *tcpobfs) init(t *tcp) {
+	o.tcp = t
+	o.forDialer = &TcpUpgrade{
+		upgrade: o.upgradeDialer,
+		name:    "obfs",
+	}
+	o.forListener = &TcpUpgrade{
+		upgrade: o.upgradeListener,
+		name:    "obfs",
+	}
+	o.mutex.Lock()
+	o.seen = make(map[[obfsSaltLength]byte]time.Time)
+	o.mutex.Unlock()
+}
+
+// Derives the key for one direction of a connection from the listener's key.
+func obfsKey(public []byte, salt []byte, info []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, public, salt, string(info), chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// Gets a random number in [0, n].
+func obfsRandom(n int) int {
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(n)+1))
+	if err != nil {
+		return 0
+	}
+	return int(r.Int64())
+}
+
+func (o *tcpobfs) upgradeDialer(c net.Conn, options *tcpOptions) (net.Conn, error) {
+	if len(options.pinnedEd25519Keys) != 1 {
+		return c, errors.New("obfs peers must have exactly one pinned key")
+	}
+	var public keyArray
+	for key := range options.pinnedEd25519Keys {
+		public = key
+	}
+	clientSalt := make([]byte, obfsSaltLength)
+	if _, err := rand.Read(clientSalt); err != nil {
+		return c, err
+	}
+	conn := &obfsConn{Conn: c}
+	var err error
+	if conn.writeAEAD, err = obfsKey(public[:], clientSalt, obfsClientInfo); err != nil {
+		return c, err
+	}
+	if err = conn.writeFrame(clientSalt, nil, obfsRandom(obfsMaxHandshakePadding)); err != nil {
+		return c, err
+	}
+	serverSalt := make([]byte, obfsSaltLength)
+	if _, err = io.ReadFull(c, serverSalt); err != nil {
+		return c, err
+	}
+	if conn.readAEAD, err = obfsKey(public[:], append(clientSalt, serverSalt...), obfsServerInfo); err != nil {
+		return c, err
+	}
+	return conn, nil
+}
+
+func (o *tcpobfs) upgradeListener(c net.Conn, options *tcpOptions) (net.Conn, error) {
+	public := o.tcp.links.core.public
+	clientSalt := make([]byte, obfsSaltLength)
+	if _, err := io.ReadFull(c, clientSalt); err != nil {
+		return c, err
+	}
+	conn := &obfsConn{Conn: c}
+	var err error
+	if conn.readAEAD, err = obfsKey(public, clientSalt, obfsClientInfo); err != nil {
+		return c, err
+	}
+	// Anything that isn't from a peer that knows our key gets no reply at all,
+	// and neither does a copy of a real peer's handshake
+	if err = conn.readFrame(); err != nil || !o.checkReplay(clientSalt) {
+		_, _ = io.Copy(io.Discard, c)
+		return c, errors.New("obfs handshake failed")
+	}
+	serverSalt := make([]byte, obfsSaltLength)
+	if _, err = rand.Read(serverSalt); err != nil {
+		return c, err
+	}
+	if conn.writeAEAD, err = obfsKey(public, append(clientSalt, serverSalt...), obfsServerInfo); err != nil {
+		return c, err
+	}
+	if err = conn.writeFrame(serverSalt, nil, obfsRandom(obfsMaxHandshakePadding)); err != nil {
+		return c, err
+	}
+	return conn, nil
+}
+
+// Checks that a client's salt hasn't been seen recently, and remembers it.
+func (o *tcpobfs) checkReplay(salt []byte) bool {
+	var s [obfsSaltLength]byte
+	copy(s[:], salt)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	now := time.Now()
+	for seen, when := range o.seen {
+		if now.Sub(when) > obfsReplayWindow {
+			delete(o.seen, seen)
+		}
+	}
+	if _, isIn := o.seen[s]; isIn {
+		return false
+	}
+	o.seen[s] = now
+	return true
+}
+
+// obfsConn encrypts and pads everything that is written to it, in frames of an
+// encrypted header with the lengths followed by the encrypted payload and
+// padding. Each direction has its own key, and uses a counter as the nonce.
+type obfsConn struct {
+	net.Conn
+	wmutex     sync.Mutex // Protects writeAEAD and writeNonce
+	writeAEAD  cipher.AEAD
+	writeNonce uint64
+	readAEAD   cipher.AEAD
+	readNonce  uint64
+	readBuf    []byte // Payload that has been decrypted but not read yet
+}
+
+func obfsNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+// Writes a frame with the given payload and amount of padding, after prefix,
+// in a single write.
+func (c *obfsConn) writeFrame(prefix, payload []byte, padding int) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	header := make([]byte, obfsHeaderLength)
+	binary.BigEndian.PutUint16(header[0:], uint16(len(payload)))
+	binary.BigEndian.PutUint16(header[2:], uint16(padding))
+	body := make([]byte, len(payload)+padding)
+	copy(body, payload)
+	frame := append([]byte(nil), prefix...)
+	frame = c.writeAEAD.Seal(frame, obfsNonce(c.writeNonce), header, nil)
+	frame = c.writeAEAD.Seal(frame, obfsNonce(c.writeNonce+1), body, nil)
+	c.writeNonce += 2
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *obfsConn) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		size := min(len(p), obfsMaxPayload)
+		if err := c.writeFrame(nil, p[:size], obfsRandom(obfsMaxPadding)); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Reads the next frame into readBuf. Only one goroutine reads at a time.
+func (c *obfsConn) readFrame() error {
+	overhead := c.readAEAD.Overhead()
+	header := make([]byte, obfsHeaderLength+overhead)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	header, err := c.readAEAD.Open(header[:0], obfsNonce(c.readNonce), header, nil)
+	if err != nil {
+		return errors.New("obfs failed to decrypt frame header")
+	}
+	length := int(binary.BigEndian.Uint16(header[0:]))
+	padding := int(binary.BigEndian.Uint16(header[2:]))
+	body := make([]byte, length+padding+overhead)
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		return err
+	}
+	if body, err = c.readAEAD.Open(body[:0], obfsNonce(c.readNonce+1), body, nil); err != nil {
+		return errors.New("obfs failed to decrypt frame")
+	}
+	c.readNonce += 2
+	c.readBuf = body[:length]
+	return nil
+}
+
+func (c *obfsConn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
@@ -0,0 +1,309 @@
+package core
+
+// This keeps track of the peers that are configured, either in the Peers and
+// InterfacePeers sections of the configuration, in the PeersFile or with
+// AddPeer, and calls them again when they disconnect or fail to connect. Each
+// peer backs off exponentially, with jitter, so that a peer that is down isn't
+// hammered with connection attempts, and so that nodes that lost their links at
+// the same time don't all try to reconnect at the same time. Peers that are
+// backing off are retried straight away when a network interface comes up.
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// How often the configuration and the network interfaces are checked for
+// changes.
+const peerLoopInterval = 5 * time.Second
+
+// The range of delays between connection attempts to a configured peer. The
+// delay starts at the minimum and doubles after each failure up to the maximum.
+// It goes back to the minimum once a link has stayed up for the maximum.
+const (
+	peerBackoffMin = time.Second
+	peerBackoffMax = time.Minute
+)
+
+// The states that a configured peer can be in.
+const (
+	peerStateDialing   = "dialing"
+	peerStateConnected = "connected"
+	peerStateBackoff   = "backing off"
+	peerStateFailed    = "failed"    // The URI can't be used, so it won't be retried
+	peerStateResolving = "resolving" // A srv:// peer is being looked up for the first time
+	peerStateResolved  = "resolved"  // A srv:// peer has been expanded into its targets
+)
+
+// peerKey identifies a configured peer. The URI is normalised so that
+// differently written forms of the same URI are treated as the same peer.
+type peerKey struct {
+	uri   string
+	sintf string
+}
+
+type configuredPeer struct {
+	key       peerKey
+	url       *url.URL
+	state     string
+	lastErr   error
+	backoff   time.Duration
+	next      time.Time // When the next attempt will be made, while backing off
+	timer     *time.Timer
+	connected time.Time // When the current link came up, while connected
+	removed   bool
+	srv       *srvPeer        // The targets of a srv:// peer
+	parent    *configuredPeer // The srv:// peer that this is a target of, if any
+}
+
+// Reads the configured peers, keyed by their normalised URI and interface, and
+// returns the URIs that failed to parse along with the reason why.
+func (c *Core) _configuredPeers() (map[peerKey]*url.URL, map[peerKey]error) {
+	peers := make(map[peerKey]*url.URL)
+	invalid := make(map[peerKey]error)
+	add := func(peer, intf string) {
+		u, err := url.Parse(peer)
+		if err != nil {
+			invalid[peerKey{peer, intf}] = err
+			return
+		}
+		peers[peerKey{u.String(), intf}] = u
+	}
+	c.config.RLock()
+	// Add peers from the Peers section
+	for _, peer := range c.config.Peers {
+		add(peer, "")
+	}
+	// Add peers from the InterfacePeers section
+	for intf, intfpeers := range c.config.InterfacePeers {
+		for _, peer := range intfpeers {
+			add(peer, intf)
+		}
+	}
+	path := c.config.PeersFile
+	c.config.RUnlock()
+	// Add peers from the peers file, which is read without holding the lock
+	// on the configuration, since the disk may be slow
+	for _, key := range c._readPeersFile(path) {
+		add(key.uri, key.sintf)
+	}
+	return peers, invalid
+}
+
+// Starts tracking a configured peer and makes the first attempt to call it.
+func (c *Core) _addConfiguredPeer(key peerKey, u *url.URL) error {
+	p := &configuredPeer{key: key, url: u}
+	c.peers[key] = p
+	if u.Scheme == "srv" {
+		var err error
+		if p.srv, err = parseSRVPeer(u); err != nil {
+			p.state = peerStateFailed
+			p.lastErr = err
+			return err
+		}
+		c._resolveSRVPeer(p)
+		return nil
+	}
+	return c._callConfiguredPeer(p)
+}
+
+// Stops tracking a configured peer, cancels any pending attempt to call it and
+// closes any links that are open to it. Removing a srv:// peer removes all of
+// its targets too.
+func (c *Core) _removeConfiguredPeer(p *configuredPeer) {
+	p.removed = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(c.peers, p.key)
+	if p.srv != nil {
+		for _, child := range p.srv.children {
+			c._removeConfiguredPeer(child)
+		}
+	}
+	if p.parent != nil {
+		delete(p.parent.srv.children, p.key)
+	}
+	if p.url != nil {
+		c.links.closeCalled(p.url, p.key.sintf)
+	}
+}
+
+// Calls a configured peer, with callbacks that keep track of its state.
+func (c *Core) _callConfiguredPeer(p *configuredPeer) error {
+	p.state = peerStateDialing
+	p.next = time.Time{}
+	options := linkOptions{
+		onConnected: func() {
+			c.Act(nil, func() {
+				if p.removed {
+					// The peer was removed while this call was still in its
+					// handshake, so there was no link to close at the time
+					c.links.closeCalled(p.url, p.key.sintf)
+					return
+				}
+				p.state = peerStateConnected
+				p.connected = time.Now()
+				p.lastErr = nil
+			})
+		},
+		onDisconnected: func(err error) {
+			c.Act(nil, func() {
+				c._configuredPeerDisconnected(p, err)
+			})
+		},
+	}
+	if err := c.links.call(p.url, p.key.sintf, options); err != nil {
+		p.state = peerStateFailed
+		p.lastErr = err
+		return err
+	}
+	return nil
+}
+
+// Schedules the next attempt to call a configured peer once a call is over,
+// whether or not it connected.
+func (c *Core) _configuredPeerDisconnected(p *configuredPeer, err error) {
+	if p.removed {
+		return
+	}
+	if !p.connected.IsZero() && time.Since(p.connected) >= peerBackoffMax {
+		p.backoff = 0
+	}
+	p.connected = time.Time{}
+	if err == nil {
+		err = errors.New("disconnected")
+	}
+	p.lastErr = err
+	switch {
+	case p.backoff < peerBackoffMin:
+		p.backoff = peerBackoffMin
+	case p.backoff < peerBackoffMax:
+		p.backoff *= 2
+		if p.backoff > peerBackoffMax {
+			p.backoff = peerBackoffMax
+		}
+	}
+	// Wait for somewhere between half and all of the backoff
+	delay := p.backoff/2 + time.Duration(rand.Int63n(int64(p.backoff/2)+1))
+	p.state = peerStateBackoff
+	p.next = time.Now().Add(delay)
+	p.timer = time.AfterFunc(delay, func() {
+		c.Act(nil, func() {
+			c._retryConfiguredPeer(p)
+		})
+	})
+}
+
+// Calls a configured peer now if it is waiting to be called again.
+func (c *Core) _retryConfiguredPeer(p *configuredPeer) {
+	if p.removed || p.state != peerStateBackoff {
+		return
+	}
+	if p.srv != nil {
+		c._resolveSRVPeer(p)
+		return
+	}
+	p.timer.Stop()
+	if err := c._callConfiguredPeer(p); err != nil {
+		c.log.Errorln("Failed to add peer:", err)
+	}
+}
+
+// Gets the names of the network interfaces that are up and have an address.
+func peerInterfacesUp() map[string]struct{} {
+	up := make(map[string]struct{})
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return up
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if addrs, err := iface.Addrs(); err == nil && len(addrs) > 0 {
+			up[iface.Name] = struct{}{}
+		}
+	}
+	return up
+}
+
+// Calls the configured peers that aren't being called yet, and stops calling
+// those that are no longer configured.
+func (c *Core) _updateConfiguredPeers() {
+	peers, invalid := c._configuredPeers()
+	for key, p := range c.peers {
+		if p.parent != nil {
+			// Targets of srv:// peers come and go with their records
+			continue
+		}
+		_, ok := peers[key]
+		if _, bad := invalid[key]; !ok && !bad && !p.removed {
+			c._removeConfiguredPeer(p)
+		}
+	}
+	for key, err := range invalid {
+		if _, ok := c.peers[key]; !ok {
+			c.log.Errorln("Failed to parse peer url:", key.uri, err)
+			c.peers[key] = &configuredPeer{key: key, state: peerStateFailed, lastErr: err}
+		}
+	}
+	for key, u := range peers {
+		if _, ok := c.peers[key]; !ok {
+			if err := c._addConfiguredPeer(key, u); err != nil {
+				c.log.Errorln("Failed to add peer:", err)
+			}
+		}
+	}
+}
+
+// If any static peers were provided in the configuration above then we should
+// configure them. The loop ensures that disconnected peers will eventually
+// be reconnected with, and picks up any changes to the configured peers.
+func (c *Core) _addPeerLoop() {
+	if c.addPeerTimer == nil {
+		return
+	}
+
+	c._updateConfiguredPeers()
+	for _, p := range c.peers {
+		if p.srv != nil {
+			c._checkSRVPeer(p)
+		}
+	}
+
+	// If an interface has come up since we last looked, then there's a good
+	// chance that peers which failed before will work now, so don't make them
+	// wait for their backoff to expire
+	up := peerInterfacesUp()
+	for name := range up {
+		if _, ok := c.interfacesUp[name]; ok || c.interfacesUp == nil {
+			continue
+		}
+		c.log.Debugln("Interface", name, "is up, retrying peers")
+		for _, p := range c.peers {
+			if p.key.sintf == "" || p.key.sintf == name {
+				c._retryConfiguredPeer(p)
+			}
+		}
+	}
+	c.interfacesUp = up
+
+	c.addPeerTimer = time.AfterFunc(peerLoopInterval, func() {
+		c.Act(nil, c._addPeerLoop)
+	})
+}
+
+// Stops tracking all configured peers, when shutting down.
+func (c *Core) _stopConfiguredPeers() {
+	for _, p := range c.peers {
+		p.removed = true
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	c.peers = nil
+}
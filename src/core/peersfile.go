@@ -0,0 +1,135 @@
+package core
+
+// This reads peers from the file named by PeersFile, alongside those in the
+// configuration, so that tools that manage the list of peers can change it
+// without restarting the node. The file is checked for changes every time the
+// configured peers are, and is only read again when its size or modification
+// time changes. Peers that are added are called straight away and peers that
+// are removed are disconnected, while the links to the rest are left alone.
+//
+// Each line of the file holds a peer URI, optionally followed by the name of
+// the interface to call it on, as in InterfacePeers. Blank lines and lines
+// starting with # are ignored.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// peersFile is the last version of the peers file that was read.
+type peersFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	peers   []peerKey // The peers in the file, with their URIs as written
+	err     error     // Why the file couldn't be read, if it couldn't
+}
+
+// Reads the peers from the file at path, if it has changed since it was last
+// read, and logs the differences. If the file can't be read then the peers
+// from the last time that it could be are kept, so that a file that is being
+// replaced doesn't drop every link.
+func (c *Core) _readPeersFile(path string) []peerKey {
+	f := &c.peersFile
+	if path != f.path {
+		*f = peersFile{path: path}
+	}
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.peers
+	}
+	var peers []peerKey
+	if err == nil {
+		peers, err = parsePeersFile(path)
+	}
+	if err != nil {
+		if f.err == nil || f.err.Error() != err.Error() {
+			c.log.Errorln("Failed to read peers file:", err)
+		}
+		f.err = err
+		return f.peers
+	}
+	f.err = nil
+	if f.modTime.IsZero() {
+		c.log.Infof("Read %d peers from peers file %s", len(peers), path)
+	} else {
+		added, removed := diffPeers(f.peers, peers)
+		c.log.Infof("Peers file %s changed: %d added, %d removed", path, len(added), len(removed))
+		for _, key := range added {
+			c.log.Infoln("Peers file added peer:", peerKeyString(key))
+		}
+		for _, key := range removed {
+			c.log.Infoln("Peers file removed peer:", peerKeyString(key))
+		}
+	}
+	f.modTime, f.size, f.peers = info.ModTime(), info.Size(), peers
+	return peers
+}
+
+// Reads the peer URIs and interfaces from a peers file.
+func parsePeersFile(path string) ([]peerKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var peers []peerKey
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+			continue
+		case len(fields) > 2:
+			return nil, fmt.Errorf("%s:%d: expected a peer URI and optionally an interface", path, line)
+		case len(fields) == 2:
+			peers = append(peers, peerKey{fields[0], fields[1]})
+		default:
+			peers = append(peers, peerKey{fields[0], ""})
+		}
+	}
+	return peers, scanner.Err()
+}
+
+// Finds the peers that are in b but not a, and those that are in a but not b.
+func diffPeers(a, b []peerKey) (added, removed []peerKey) {
+	inA := make(map[peerKey]struct{}, len(a))
+	for _, key := range a {
+		inA[key] = struct{}{}
+	}
+	inB := make(map[peerKey]struct{}, len(b))
+	for _, key := range b {
+		inB[key] = struct{}{}
+		if _, ok := inA[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	for _, key := range a {
+		if _, ok := inB[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sortPeers := func(keys []peerKey) {
+		sort.Slice(keys, func(i, j int) bool {
+			return peerKeyString(keys[i]) < peerKeyString(keys[j])
+		})
+	}
+	sortPeers(added)
+	sortPeers(removed)
+	return added, removed
+}
+
+// Describes a peer for the logs.
+func peerKeyString(key peerKey) string {
+	if key.sintf == "" {
+		return key.uri
+	}
+	return key.uri + " on " + key.sintf
+}
@@ -0,0 +1,195 @@
+package core
+
+// This measures the round-trip time, jitter and loss of each link by sending
+// pings on it, if both sides support the "ping" capability. Pings and their
+// replies are framed like the router's packets, with a packet type that the
+// router never uses, and linkConn takes them out of the stream before the
+// router sees them.
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// How often a link is pinged. A ping that hasn't been answered by the time
+// that the next one is sent is counted as lost.
+const linkPingInterval = 2 * time.Second
+
+// The packet type used for pings and their replies. The router's own packet
+// types count up from 0, so this won't clash with them.
+const linkPingType = 0xff
+
+const (
+	linkPingRequest = 0
+	linkPingReply   = 1
+)
+
+// The length of a ping packet after the 2 byte length: type, request or reply,
+// and an 8 byte sequence number.
+const linkPingLength = 1 + 1 + 8
+
+// The weights given to new samples when smoothing, as in RFC 6298.
+const (
+	linkPingRTTWeight    = 1.0 / 8
+	linkPingJitterWeight = 1.0 / 4
+	linkPingLossWeight   = 1.0 / 8
+)
+
+// linkStats is a snapshot of the measurements of a link.
+type linkStats struct {
+	rtt    time.Duration // Smoothed round-trip time
+	jitter time.Duration // Smoothed mean deviation of the round-trip time
+	loss   float64       // Smoothed fraction of pings that went unanswered
+}
+
+// Starts pinging the link and taking pings and replies out of the stream that
+// is read by the router. This must only be called once the handshake is done.
+func (c *linkConn) startPings() {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	c.pings = true
+	c.pingTimer = time.AfterFunc(0, c.ping)
+}
+
+// Sends a ping, first counting the previous one as lost if it hasn't been
+// answered yet.
+func (c *linkConn) ping() {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	if c.pingStopped {
+		return
+	}
+	if !c.pingSent.IsZero() {
+		c.stats.loss += linkPingLossWeight * (1 - c.stats.loss)
+	}
+	c.pingSeq++
+	c.pingSent = time.Now()
+	c.pingTimer = time.AfterFunc(linkPingInterval, c.ping)
+	go c.sendPing(linkPingRequest, c.pingSeq)
+}
+
+// Sends a ping or reply. This is done in its own goroutine, so that a reply
+// doesn't hold up the reader while the link is busy.
+func (c *linkConn) sendPing(kind uint8, seq uint64) {
+	bs := make([]byte, 2, 2+linkPingLength)
+	binary.BigEndian.PutUint16(bs, linkPingLength)
+	bs = append(bs, linkPingType, kind)
+	bs = binary.BigEndian.AppendUint64(bs, seq)
+	_, _ = c.Write(bs)
+}
+
+// Queues a reply to a ping from the remote side. Only the newest ping is
+// answered if several arrive while a reply is being sent, and only one
+// goroutine sends replies at a time, so a flood of pings can't pile up
+// goroutines waiting to write.
+func (c *linkConn) replyPing(seq uint64) {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	c.replySeq, c.replyDue = seq, true
+	if !c.replying {
+		c.replying = true
+		go c.sendPingReplies()
+	}
+}
+
+// Sends replies until there are none left to send.
+func (c *linkConn) sendPingReplies() {
+	for {
+		c.pmutex.Lock()
+		if !c.replyDue || c.pingStopped {
+			c.replying = false
+			c.pmutex.Unlock()
+			return
+		}
+		seq := c.replySeq
+		c.replyDue = false
+		c.pmutex.Unlock()
+		c.sendPing(linkPingReply, seq)
+	}
+}
+
+// Handles a reply to one of our pings, updating the measurements.
+func (c *linkConn) handlePingReply(seq uint64) {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	if seq != c.pingSeq || c.pingSent.IsZero() {
+		return // Too late, it has already been counted as lost
+	}
+	rtt := time.Since(c.pingSent)
+	c.pingSent = time.Time{}
+	if !c.measured {
+		c.stats.rtt, c.stats.jitter = rtt, rtt/2
+		c.measured = true
+	} else {
+		diff := c.stats.rtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.stats.jitter += time.Duration(linkPingJitterWeight * float64(diff-c.stats.jitter))
+		c.stats.rtt += time.Duration(linkPingRTTWeight * float64(rtt-c.stats.rtt))
+	}
+	c.stats.loss -= linkPingLossWeight * c.stats.loss
+}
+
+// Gets the measurements so far, and whether there are any yet.
+func (c *linkConn) getStats() (linkStats, bool) {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	return c.stats, c.measured
+}
+
+// Stops sending pings.
+func (c *linkConn) stopPings() {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	c.pingStopped = true
+	if c.pingTimer != nil {
+		c.pingTimer.Stop()
+	}
+}
+
+// Reads packets from the link until there is one for the router, handling any
+// pings and replies along the way, and then gives it to the router a piece at
+// a time. Only the router's reader calls this, so the buffers need no lock,
+// and each packet is read into the same buffer, since the router has read all
+// of the last one before the next is read.
+func (c *linkConn) readPackets(p []byte) (int, error) {
+	if c.packetBuf == nil {
+		c.packetBuf = make([]byte, 2+math.MaxUint16)
+	}
+	for len(c.readBuf) == 0 {
+		header := c.packetBuf[:2]
+		if _, err := io.ReadFull(linkRawReader{c}, header); err != nil {
+			return 0, err
+		}
+		packet := c.packetBuf[:2+int(binary.BigEndian.Uint16(header))]
+		if _, err := io.ReadFull(linkRawReader{c}, packet[2:]); err != nil {
+			return 0, err
+		}
+		if len(packet) != 2+linkPingLength || packet[2] != linkPingType {
+			c.readBuf = packet
+			break
+		}
+		seq := binary.BigEndian.Uint64(packet[4:])
+		switch packet[3] {
+		case linkPingRequest:
+			c.replyPing(seq)
+		case linkPingReply:
+			c.handlePingReply(seq)
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// linkRawReader reads from a linkConn without taking pings out of the stream.
+type linkRawReader struct {
+	c *linkConn
+}
+
+func (r linkRawReader) Read(p []byte) (int, error) {
+	return r.c.read(p)
+}
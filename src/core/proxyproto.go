@@ -0,0 +1,137 @@
+package core
+
+// This adds support for the PROXY protocol, versions 1 and 2, on tcp:// and
+// tls:// listeners that sit behind a load balancer such as HAProxy. The load
+// balancer sends a header with the real client address at the start of each
+// connection, which is read before anything else so that the link and the logs
+// show the client rather than the load balancer. It is enabled by adding
+// ?proxyprotocol=1 to the listener URI, along with ?proxysource= set to the
+// addresses or prefixes of the load balancers, separated by commas. Anything
+// can send a header, so connections from anywhere else are dropped before it
+// is read, and the load balancers are rate limited as well as the clients.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	proxyProtocolV1Prefix = []byte("PROXY ")
+	proxyProtocolV2Prefix = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// The longest that a version 1 header can be, including the CRLF.
+const proxyProtocolV1MaxLength = 107
+
+// proxyConn reports the client address from the PROXY header as the remote
+// address.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Reads the PROXY header from the start of the connection, and returns a
+// connection that reports the address from it. The caller should set a
+// deadline first. If the header says that the connection was made by the load
+// balancer itself, e.g. for a health check, then the address isn't changed.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReaderSize(conn, 256)
+	prefix, err := r.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if bytes.Equal(prefix, proxyProtocolV1Prefix) {
+		remote, err = readProxyHeaderV1(r)
+	} else if prefix, err = r.Peek(len(proxyProtocolV2Prefix)); err == nil && bytes.Equal(prefix, proxyProtocolV2Prefix) {
+		remote, err = readProxyHeaderV2(r)
+	} else if err == nil {
+		err = errors.New("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result net.Conn = &bufferedConn{Conn: conn, r: r}
+	if remote != nil {
+		result = &proxyConn{Conn: result, remote: remote}
+	}
+	return result, nil
+}
+
+// Reads a version 1 header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return nil, nil
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return nil, errors.New("invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid address in PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Reads a version 2 header, which is binary.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Prefix)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL, i.e. the load balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.New("unsupported PROXY protocol command")
+	}
+	// Anything after the addresses is a list of TLVs, which we don't need
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("invalid address in PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("invalid address in PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
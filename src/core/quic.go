@@ -0,0 +1,135 @@
+package core
+
+// This adds QUIC as a link type. Each QUIC connection carries exactly one
+// bidirectional stream, which is presented to the rest of the link code as a
+// net.Conn so that it can go through the same tcp.handler flow as TCP and TLS.
+// TLS is built into QUIC, so the same self-signed ed25519 certificate and key
+// pinning as tcptls is used for the handshake. QUIC connections are identified
+// by connection IDs rather than by address, so a link survives the remote end
+// roaming between networks.
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const quicALPN = "yggdrasil"
+
+// The QUIC link configuration. Keepalives are sent often enough to keep NAT
+// mappings open, and the idle timeout is long enough that a roaming node has
+// a chance to reappear from a new address before the link is dropped.
+var quicConfig = &quic.Config{
+	HandshakeIdleTimeout: default_timeout,
+	MaxIdleTimeout:       time.Minute,
+	KeepAlivePeriod:      20 * time.Second,
+}
+
+// quicStream wraps the single bidirectional stream of a QUIC connection so
+// that it satisfies net.Conn. Closing it closes the whole QUIC connection.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *quicStream) Close() error {
+	_ = s.Stream.Close()
+	return s.conn.CloseWithError(0, "link closed")
+}
+
+// quicListener adapts a QUIC listener to a net.Listener, which returns the
+// first stream of each incoming QUIC connection from Accept.
+type quicListener struct {
+	*quic.Listener
+	tcp     *tcp
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan net.Conn
+}
+
+func (t *tcp) listenQUIC(listenaddr string) (net.Listener, error) {
+	config := t.tls.config.Clone()
+	config.NextProtos = []string{quicALPN}
+	listener, err := quic.ListenAddr(listenaddr, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	ql := &quicListener{
+		Listener: listener,
+		tcp:      t,
+		streams:  make(chan net.Conn),
+	}
+	ql.ctx, ql.cancel = context.WithCancel(t.links.core.ctx)
+	go ql.acceptConns()
+	return ql, nil
+}
+
+// Accepts QUIC connections and spawns a goroutine for each one to wait for
+// the remote side to open its stream, so that a slow or misbehaving remote
+// cannot hold up other incoming connections.
+func (l *quicListener) acceptConns() {
+	defer l.cancel()
+	for {
+		conn, err := l.Listener.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			ctx, done := context.WithTimeout(l.ctx, default_timeout)
+			defer done()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				l.tcp.links.core.log.Debugln("Failed to accept QUIC stream:", err)
+				_ = conn.CloseWithError(0, "no stream")
+				return
+			}
+			select {
+			case l.streams <- &quicStream{stream, conn}:
+			case <-l.ctx.Done():
+				_ = conn.CloseWithError(0, "listener closed")
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// Dials a QUIC connection to the given address and opens the stream that the
+// link will run over.
+func (t *tcp) dialQUIC(ctx context.Context, saddr string, options *tcpOptions) (net.Conn, error) {
+	config := t.tls.configForOptions(options)
+	config.NextProtos = []string{quicALPN}
+	config.ServerName = options.tlsSNI
+	conn, err := quic.DialAddr(ctx, saddr, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "no stream")
+		return nil, err
+	}
+	return &quicStream{stream, conn}, nil
+}
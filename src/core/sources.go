@@ -0,0 +1,84 @@
+package core
+
+// This limits which addresses incoming connections are accepted from, using
+// lists of allowed and denied prefixes that are set globally by the
+// AllowedListenSources and DeniedListenSources options and for each listener by
+// ?allowsource= and ?denysource= in its URI. Connections are checked as soon
+// as they are accepted, before any work is done on the TLS or link handshake.
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// sourceFilter is a list of prefixes that connections may come from and a list
+// of prefixes that they may not come from. If the allowed list is empty then
+// connections from anywhere that isn't denied are accepted.
+type sourceFilter struct {
+	allowed []netip.Prefix
+	denied  []netip.Prefix
+}
+
+// Parses a list of prefixes, e.g. "192.0.2.0/24", or single addresses. Each
+// entry may itself be a comma-separated list, as used in listener URIs.
+func parseSourcePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range list {
+		for _, s := range strings.Split(entry, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				addr, err := netip.ParseAddr(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid source %q", s)
+				}
+				addr = addr.Unmap()
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %q", s)
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes, nil
+}
+
+// Creates a filter from lists of allowed and denied prefixes.
+func newSourceFilter(allowed, denied []string) (sourceFilter, error) {
+	var f sourceFilter
+	var err error
+	if f.allowed, err = parseSourcePrefixes(allowed); err != nil {
+		return f, err
+	}
+	if f.denied, err = parseSourcePrefixes(denied); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// Checks whether connections from the given address are accepted.
+func (f *sourceFilter) allows(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range f.denied {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allowed) == 0 {
+		return true
+	}
+	for _, prefix := range f.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
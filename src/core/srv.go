@@ -0,0 +1,241 @@
+package core
+
+// This adds srv:// peers, which look up the peers to call in DNS, so that a
+// set of public peers can be published under one name and its hosts changed
+// without touching the configuration of every node that uses them. A peer URI
+// like srv://_yggdrasil._tcp.example.org is expanded into the targets of the
+// SRV records for that name, and the node calls ?count= of them (2 by
+// default), chosen by priority and then weight as described in RFC 2782. The
+// targets are called as ordinary configured peers with the scheme given by
+// ?scheme= (tls by default), and any other query parameters are passed on to
+// them. The keys of each target are pinned from TXT records on its name of the
+// form "key=<hex>", if there are any.
+//
+// The records are looked up again every srvRefreshInterval, or sooner while
+// any of the chosen targets isn't connected, and targets that are down are
+// swapped for others if there are any.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	srvRefreshInterval = 5 * time.Minute  // How often the records are looked up again
+	srvRetryInterval   = 30 * time.Second // How soon they are looked up again if something is wrong
+	srvDefaultCount    = 2
+	srvDefaultScheme   = "tls"
+	srvTXTKeyPrefix    = "key="
+)
+
+// The schemes that targets can be called with, which all take a host and port.
+var srvSchemes = map[string]struct{}{
+	"tcp":  {},
+	"tls":  {},
+	"quic": {},
+	"obfs": {},
+}
+
+// srvPeer keeps track of the targets that a srv:// peer has been expanded into.
+type srvPeer struct {
+	scheme    string
+	count     int
+	query     url.Values // Passed on to the targets
+	children  map[peerKey]*configuredPeer
+	resolving bool
+	resolved  time.Time // When the records were last looked up
+	refresh   time.Time // When the records should be looked up again
+}
+
+// Reads the options of a srv:// peer URI.
+func parseSRVPeer(u *url.URL) (*srvPeer, error) {
+	if u.Host == "" || u.Port() != "" || u.Path != "" {
+		return nil, fmt.Errorf("peer %s is not correctly formatted (expected srv://name)", u)
+	}
+	srv := &srvPeer{
+		scheme:   srvDefaultScheme,
+		count:    srvDefaultCount,
+		query:    u.Query(),
+		children: make(map[peerKey]*configuredPeer),
+	}
+	if scheme := srv.query.Get("scheme"); scheme != "" {
+		if _, ok := srvSchemes[scheme]; !ok {
+			return nil, fmt.Errorf("peer %s is not correctly formatted (targets can't be called with scheme %s)", u, scheme)
+		}
+		srv.scheme = scheme
+	}
+	if count := srv.query.Get("count"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("peer %s is not correctly formatted (invalid count %q)", u, count)
+		}
+		srv.count = n
+	}
+	srv.query.Del("scheme")
+	srv.query.Del("count")
+	return srv, nil
+}
+
+// Looks up the SRV records for the name, and the TXT records of each target,
+// and returns the URIs to call the targets with in order of preference.
+func (srv *srvPeer) lookup(ctx context.Context, name string) ([]*url.URL, error) {
+	ctx, done := context.WithTimeout(ctx, default_timeout)
+	defer done()
+	_, records, err := dnsResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*url.URL
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		if host == "" {
+			// A target of "." means that the service isn't available
+			continue
+		}
+		query := url.Values{}
+		for k, v := range srv.query {
+			query[k] = append([]string(nil), v...)
+		}
+		txts, err := dnsResolver.LookupTXT(ctx, host)
+		var dnsErr *net.DNSError
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			// Don't call a target without the keys that it may have been meant
+			// to have pinned
+			continue
+		}
+		for _, txt := range txts {
+			if key, ok := strings.CutPrefix(txt, srvTXTKeyPrefix); ok {
+				query.Add("key", key)
+			}
+		}
+		targets = append(targets, &url.URL{
+			Scheme:   srv.scheme,
+			Host:     net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+			RawQuery: query.Encode(),
+		})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no usable SRV records found for %s", name)
+	}
+	return targets, nil
+}
+
+// Looks up the records for a srv:// peer in the background, unless that is
+// already happening.
+func (c *Core) _resolveSRVPeer(p *configuredPeer) {
+	if p.srv.resolving {
+		return
+	}
+	p.srv.resolving = true
+	if p.state != peerStateResolved {
+		p.state = peerStateResolving
+	}
+	p.next = time.Time{}
+	name := p.url.Host
+	go func() {
+		targets, err := p.srv.lookup(c.ctx, name)
+		c.Act(nil, func() {
+			c._srvPeerResolved(p, targets, err)
+		})
+	}()
+}
+
+// Updates the targets of a srv:// peer once its records have been looked up.
+func (c *Core) _srvPeerResolved(p *configuredPeer, targets []*url.URL, err error) {
+	p.srv.resolving = false
+	if p.removed {
+		return
+	}
+	now := time.Now()
+	p.srv.resolved = now
+	if err != nil {
+		c.log.Warnln("Failed to look up peer", p.key.uri+":", err)
+		p.state = peerStateBackoff
+		p.lastErr = err
+		p.next = now.Add(srvRetryInterval)
+		p.srv.refresh = p.next
+		return
+	}
+	p.state = peerStateResolved
+	p.lastErr = nil
+	p.srv.refresh = now.Add(srvRefreshInterval)
+	c._pickSRVTargets(p, targets)
+}
+
+// Chooses which of the targets to call. Targets that are already being called
+// are kept unless they are down, in which case they are swapped for the most
+// preferred of the others that aren't.
+func (c *Core) _pickSRVTargets(p *configuredPeer, targets []*url.URL) {
+	healthy := func(child *configuredPeer) bool {
+		return child.state == peerStateConnected || child.state == peerStateDialing
+	}
+	chosen := make(map[peerKey]*url.URL)
+	for _, u := range targets {
+		key := peerKey{u.String(), p.key.sintf}
+		if child, ok := p.srv.children[key]; ok && healthy(child) && len(chosen) < p.srv.count {
+			chosen[key] = u
+		}
+	}
+	for _, pass := range []bool{true, false} {
+		for _, u := range targets {
+			if len(chosen) >= p.srv.count {
+				break
+			}
+			key := peerKey{u.String(), p.key.sintf}
+			if _, ok := chosen[key]; ok {
+				continue
+			}
+			if child, ok := p.srv.children[key]; pass && ok && !healthy(child) {
+				// Only try the ones that are down again if there's nothing else
+				continue
+			}
+			if other, ok := c.peers[key]; ok && other.parent != p {
+				// Already called for some other reason
+				continue
+			}
+			chosen[key] = u
+		}
+	}
+	for key, child := range p.srv.children {
+		if _, ok := chosen[key]; !ok {
+			c.log.Infoln("Peer", p.key.uri, "no longer uses", key.uri)
+			c._removeConfiguredPeer(child)
+		}
+	}
+	for key, u := range chosen {
+		if _, ok := p.srv.children[key]; ok {
+			continue
+		}
+		c.log.Infoln("Peer", p.key.uri, "now uses", key.uri)
+		child := &configuredPeer{key: key, url: u, parent: p}
+		c.peers[key] = child
+		p.srv.children[key] = child
+		if err := c._callConfiguredPeer(child); err != nil {
+			c.log.Errorln("Failed to add peer:", err)
+		}
+	}
+}
+
+// Checks whether the records for a srv:// peer should be looked up again,
+// either because they are due to be or because one of its targets is down.
+func (c *Core) _checkSRVPeer(p *configuredPeer) {
+	if p.srv.resolving || p.state == peerStateFailed {
+		return
+	}
+	now := time.Now()
+	due := now.After(p.srv.refresh)
+	for _, child := range p.srv.children {
+		if child.state != peerStateConnected && child.state != peerStateDialing {
+			due = due || now.After(p.srv.resolved.Add(srvRetryInterval))
+		}
+	}
+	if due {
+		c._resolveSRVPeer(p)
+	}
+}
@@ -16,12 +16,16 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -34,13 +38,17 @@ const default_timeout = 6 * time.Second
 
 // The TCP listener and information about active TCP connections, to avoid duplication.
 type tcp struct {
-	links     *links
-	waitgroup sync.WaitGroup
-	mutex     sync.Mutex // Protecting the below
-	listeners map[string]*TcpListener
-	calls     map[string]struct{}
-	conns     map[linkInfo](chan struct{})
-	tls       tcptls
+	links      *links
+	waitgroup  sync.WaitGroup
+	mutex      sync.Mutex // Protecting the below
+	listeners  map[string]*TcpListener
+	calls      map[string]struct{}
+	conns      map[linkInfo](chan struct{})
+	transports map[string]Transport // Built in, or from RegisterTransport which may be before init
+	tls        tcptls
+	obfs       tcpobfs
+	sources    sourceFilter // From AllowedListenSources and DeniedListenSources
+	accept     acceptGuard  // Protects listeners from floods of connections
 }
 
 // TcpListener is a stoppable TCP listener interface. These are typically
@@ -60,11 +68,38 @@ type TcpUpgrade struct {
 
 type tcpOptions struct {
 	linkOptions
-	upgrade        *TcpUpgrade
-	socksProxyAddr string
-	socksProxyAuth *proxy.Auth
-	socksPeerAddr  string
-	tlsSNI         string
+	upgrade         *TcpUpgrade
+	socksProxyAddr  string
+	socksProxyAuth  *proxy.Auth
+	httpProxyAddr   string
+	httpProxyAuth   *url.Userinfo
+	proxyScheme     string       // The scheme of the peer URI if dialing through a proxy, e.g. "socks"
+	proxyPeerAddr   string       // The address that the proxy was asked to connect to
+	dialedAddr      string       // The address that a call connected to, out of those that the name resolved to
+	source          *net.TCPAddr // The address and port to call from, from ?source=, if set
+	tlsSNI          string
+	tlsVerifySystem bool           // Whether to verify the remote side's certificate against the system roots
+	tlsVerifyName   string         // The name to verify the certificate for, if tlsVerifySystem is set
+	tlsKeyPair      *tlsKeyPair    // A certificate supplied by the operator, for listeners
+	sources         sourceFilter   // Where a listener accepts connections from, as well as the global filter
+	proxyProtocol   bool           // Whether incoming connections start with a PROXY protocol header
+	proxySources    []netip.Prefix // Where connections with a PROXY protocol header may come from
+	connName        string         // Describes a connection from the application, see HandlePeerConn
+	proto           string         // Link type if not plain TCP, e.g. "quic"
+	dial            func(ctx context.Context, saddr string, o *tcpOptions) (net.Conn, error)
+}
+
+// Returns the link type for connections using these options, e.g. "tcp",
+// "tls" or "quic".
+func (o *tcpOptions) linkType() string {
+	switch {
+	case o.upgrade != nil:
+		return o.upgrade.name
+	case o.proto != "":
+		return o.proto
+	default:
+		return "tcp"
+	}
 }
 
 func (l *TcpListener) Stop() {
@@ -90,7 +125,9 @@ func (t *tcp) getAddr() *net.TCPAddr {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	for _, l := range t.listeners {
-		return l.Listener.Addr().(*net.TCPAddr)
+		if addr, ok := l.Listener.Addr().(*net.TCPAddr); ok {
+			return addr
+		}
 	}
 	return nil
 }
@@ -99,14 +136,24 @@ func (t *tcp) getAddr() *net.TCPAddr {
 func (t *tcp) init(l *links) error {
 	t.links = l
 	t.tls.init(t)
+	t.obfs.init(t)
 	t.mutex.Lock()
 	t.calls = make(map[string]struct{})
 	t.conns = make(map[linkInfo](chan struct{}))
 	t.listeners = make(map[string]*TcpListener)
 	t.mutex.Unlock()
+	for scheme, transport := range t.builtinTransports() {
+		// Already there if the node has been started before
+		_ = t.addTransport(scheme, transport)
+	}
 
 	t.links.core.config.RLock()
 	defer t.links.core.config.RUnlock()
+	var err error
+	if t.sources, err = newSourceFilter(t.links.core.config.AllowedListenSources, t.links.core.config.DeniedListenSources); err != nil {
+		return fmt.Errorf("failed to parse listen sources: %w", err)
+	}
+	t.accept.init(t.links.core.config.MaxPendingHandshakes, t.links.core.config.SourceConnectionsPerMinute)
 	for _, listenaddr := range t.links.core.config.Listen {
 		u, err := url.Parse(listenaddr)
 		if err != nil {
@@ -126,12 +173,12 @@ func (t *tcp) stop() error {
 		listener.Stop()
 	}
 	t.mutex.Unlock()
+	t.tls.stop()
 	t.waitgroup.Wait()
 	return nil
 }
 
 func (t *tcp) listenURL(u *url.URL, sintf string) (*TcpListener, error) {
-	var listener *TcpListener
 	var err error
 	hostport := u.Host // Used for tcp and tls
 	if len(sintf) != 0 {
@@ -140,37 +187,54 @@ func (t *tcp) listenURL(u *url.URL, sintf string) (*TcpListener, error) {
 			hostport = fmt.Sprintf("[%s%%%s]:%s", host, sintf, port)
 		}
 	}
-	switch u.Scheme {
-	case "tcp":
-		listener, err = t.listen(hostport, nil)
-	case "tls":
-		listener, err = t.listen(hostport, t.tls.forListener)
-	default:
-		t.links.core.log.Errorln("Failed to add listener: listener", u.String(), "is not correctly formatted, ignoring")
+	options := tcpOptions{}
+	if err = options.setQueryOptions(u.Query()); err != nil {
+		return nil, fmt.Errorf("listener %s is not correctly formatted (%s)", u.String(), err)
 	}
-	return listener, err
-}
-
-func (t *tcp) listen(listenaddr string, upgrade *TcpUpgrade) (*TcpListener, error) {
-	var err error
-
-	ctx := t.links.core.ctx
-	lc := net.ListenConfig{
-		Control: t.tcpContext,
-	}
-	listener, err := lc.Listen(ctx, "tcp", listenaddr)
-	if err == nil {
-		l := TcpListener{
-			Listener: listener,
-			opts:     tcpOptions{upgrade: upgrade},
-			stop:     make(chan struct{}),
+	if options.sources, err = newSourceFilter(u.Query()["allowsource"], u.Query()["denysource"]); err != nil {
+		return nil, fmt.Errorf("listener %s is not correctly formatted (%s)", u.String(), err)
+	}
+	if pp := u.Query().Get("proxyprotocol"); pp != "" {
+		switch {
+		case u.Scheme != "tcp" && u.Scheme != "tls":
+			return nil, fmt.Errorf("listener %s is not correctly formatted (proxyprotocol is only supported on tcp:// and tls:// listeners)", u.String())
+		case pp == "1" || pp == "true" || pp == "yes":
+			options.proxyProtocol = true
+		case pp != "0" && pp != "false" && pp != "no":
+			return nil, fmt.Errorf("listener %s is not correctly formatted (invalid proxyprotocol %q)", u.String(), pp)
 		}
-		t.waitgroup.Add(1)
-		go t.listener(&l, listenaddr)
-		return &l, nil
 	}
+	// Anyone could send a PROXY protocol header claiming to be from anywhere,
+	// so they are only read from the load balancers that are listed
+	if options.proxySources, err = parseSourcePrefixes(u.Query()["proxysource"]); err != nil {
+		return nil, fmt.Errorf("listener %s is not correctly formatted (%s)", u.String(), err)
+	}
+	switch {
+	case options.proxyProtocol && len(options.proxySources) == 0:
+		return nil, fmt.Errorf("listener %s is not correctly formatted (proxyprotocol needs the addresses of the load balancers in proxysource)", u.String())
+	case !options.proxyProtocol && len(options.proxySources) > 0:
+		return nil, fmt.Errorf("listener %s is not correctly formatted (proxysource is only used with proxyprotocol)", u.String())
+	}
+	if u.Query().Has("source") {
+		return nil, fmt.Errorf("listener %s is not correctly formatted (source is only supported on peers)", u.String())
+	}
+	return t.listenTransport(u, hostport, options)
+}
 
-	return nil, err
+// Sends an event if a link was refused because the remote side's key didn't
+// match the pinned keys during the TLS handshake.
+func (t *tcp) pinnedKeyRejected(err error, options *tcpOptions, local, remote string, incoming bool) {
+	if !errors.Is(err, errTLSPinnedKey) {
+		return
+	}
+	t.links.core.events.publish(Event{
+		Type:     EventHandshakeRejected,
+		LinkType: options.linkType(),
+		Local:    local,
+		Remote:   options.linkType() + "://" + remote,
+		Inbound:  incoming,
+		Err:      err,
+	})
 }
 
 // Runs the listener, which spawns off goroutines for incoming connections.
@@ -186,21 +250,20 @@ func (t *tcp) listener(l *TcpListener, listenaddr string) {
 		l.Listener.Close()
 		return
 	}
-	callproto := "TCP"
-	if l.opts.upgrade != nil {
-		callproto = strings.ToUpper(l.opts.upgrade.name)
-	}
+	callproto := strings.ToUpper(l.opts.linkType())
 	t.listeners[listenaddr] = l
 	t.mutex.Unlock()
 	// And here we go!
 	defer func() {
 		t.links.core.log.Infoln("Stopping", callproto, "listener on:", l.Listener.Addr().String())
+		l.event(t, EventListenerStopped)
 		l.Listener.Close()
 		t.mutex.Lock()
 		delete(t.listeners, listenaddr)
 		t.mutex.Unlock()
 	}()
 	t.links.core.log.Infoln("Listening for", callproto, "on:", l.Listener.Addr().String())
+	l.event(t, EventListenerStarted)
 	go func() {
 		<-l.stop
 		l.Listener.Close()
@@ -218,6 +281,19 @@ func (t *tcp) listener(l *TcpListener, listenaddr string) {
 			time.Sleep(time.Second) // So we don't busy loop
 			continue
 		}
+		// Behind a load balancer, the connection must come from the load
+		// balancer, and the source that it is for is only known once the PROXY
+		// protocol header has been read, so that is checked in the handler
+		var admitted bool
+		if l.opts.proxyProtocol {
+			admitted = t.admitProxy(sock.RemoteAddr(), sock.LocalAddr(), &l.opts)
+		} else {
+			admitted = t.admit(sock.RemoteAddr(), sock.LocalAddr(), &l.opts)
+		}
+		if !admitted {
+			sock.Close()
+			continue
+		}
 		t.waitgroup.Add(1)
 		options := l.opts
 		go t.handler(sock, true, options)
@@ -233,162 +309,278 @@ func (t *tcp) startCalling(saddr string) bool {
 	return !isIn
 }
 
+// Gets the TCP keepalive settings for dialers and listeners, so that the
+// kernel gives up on a dead connection at about the same time as the link read
+// timeout would. These are set through Go rather than in tcpContext, since Go
+// replaces any keepalive settings made there with its own defaults.
+func (t *tcp) keepAliveConfig() net.KeepAliveConfig {
+	interval := t.links.keepAlive
+	count := int((t.links.readTimeout - interval) / interval)
+	if count < 1 {
+		count = 1
+	}
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     interval,
+		Interval: interval,
+		Count:    count,
+	}
+}
+
 // Checks if a connection already exists.
 // If not, it adds it to the list of active outgoing calls (to block future attempts) and dials the address.
 // If the dial is successful, it launches the handler.
 // When finished, it removes the outgoing call, so reconnection attempts can be made later.
 // This all happens in a separate goroutine that it spawns.
+// If the options include an onDisconnected callback then it is called with the reason once the call is over.
 func (t *tcp) call(saddr string, options tcpOptions, sintf string) {
 	go func() {
-		callname := saddr
-		callproto := "TCP"
-		if options.upgrade != nil {
-			callproto = strings.ToUpper(options.upgrade.name)
+		var err error
+		if options.onDisconnected != nil {
+			defer func() { options.onDisconnected(err) }()
 		}
+		callname := saddr
+		callproto := strings.ToUpper(options.linkType())
 		if sintf != "" {
 			callname = fmt.Sprintf("%s/%s/%s", callproto, saddr, sintf)
 		}
 		if !t.startCalling(callname) {
+			err = errors.New("already calling " + callname)
 			return
 		}
 		defer func() {
 			// Block new calls for a little while, to mitigate livelock scenarios
-			rand.Seed(time.Now().UnixNano())
-			delay := default_timeout + time.Duration(rand.Intn(10000))*time.Millisecond
-			time.Sleep(delay)
+			// Configured peers have their own backoff, so they don't need this
+			if options.onDisconnected == nil {
+				rand.Seed(time.Now().UnixNano())
+				delay := default_timeout + time.Duration(rand.Intn(10000))*time.Millisecond
+				time.Sleep(delay)
+			}
 			t.mutex.Lock()
 			delete(t.calls, callname)
 			t.mutex.Unlock()
 		}()
 		var conn net.Conn
-		var err error
-		if options.socksProxyAddr != "" {
-			if sintf != "" {
-				return
-			}
-			dialerdst, er := net.ResolveTCPAddr("tcp", options.socksProxyAddr)
-			if er != nil {
-				return
-			}
-			var dialer proxy.Dialer
-			dialer, err = proxy.SOCKS5("tcp", dialerdst.String(), options.socksProxyAuth, proxy.Direct)
-			if err != nil {
-				return
-			}
-			ctx, done := context.WithTimeout(t.links.core.ctx, default_timeout)
-			conn, err = dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", saddr)
-			done()
-			if err != nil {
-				return
-			}
-			t.waitgroup.Add(1)
-			options.socksPeerAddr = saddr
-			if ch := t.handler(conn, false, options); ch != nil {
-				<-ch
-			}
-		} else {
-			dst, err := net.ResolveTCPAddr("tcp", saddr)
-			if err != nil {
-				return
-			}
-			if dst.IP.IsLinkLocalUnicast() {
-				dst.Zone = sintf
-				if dst.Zone == "" {
-					return
-				}
-			}
-			dialer := net.Dialer{
-				Control: t.tcpContext,
+		if conn, err = t.dial(saddr, &options); err != nil {
+			t.links.core.log.Debugf("Failed to dial %s: %s", callproto, err)
+			// QUIC checks the pinned keys while dialing, rather than in an
+			// upgrade, and its errors wrap the reason
+			t.pinnedKeyRejected(err, &options, "", saddr, false)
+			return
+		}
+		t.waitgroup.Add(1)
+		var ch chan struct{}
+		if ch, err = t.handler(conn, false, options); ch != nil {
+			<-ch
+		}
+	}()
+}
+
+// Parses the address and port to call from, as given by ?source=, e.g.
+// "192.0.2.1:4000" or "[2001:db8::1]:4000". Either the address or the port can
+// be left out, e.g. "192.0.2.1" or ":4000", to let the system choose it.
+func parseSource(s string) (*net.TCPAddr, error) {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return &net.TCPAddr{IP: ip.Unmap().AsSlice(), Zone: ip.Zone()}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q", s)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", port)
+	}
+	source := &net.TCPAddr{Port: int(p)}
+	if host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address %q", host)
+		}
+		source.IP, source.Zone = ip.Unmap().AsSlice(), ip.Zone()
+	}
+	return source, nil
+}
+
+// Dials a peer with the transport that the call was set up for, see
+// links.callTransport.
+func (t *tcp) dial(saddr string, options *tcpOptions) (net.Conn, error) {
+	ctx, done := context.WithTimeout(t.links.core.ctx, default_timeout)
+	defer done()
+	return options.dial(ctx, saddr, options)
+}
+
+// Dials a socks:// peer through the SOCKS5 proxy.
+func (t *tcp) dialSOCKS(ctx context.Context, saddr string, options *tcpOptions) (net.Conn, error) {
+	dialerdst, err := net.ResolveTCPAddr("tcp", options.socksProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.SOCKS5("tcp", dialerdst.String(), options.socksProxyAuth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", saddr)
+	if err != nil {
+		return nil, err
+	}
+	options.proxyPeerAddr = saddr
+	return conn, nil
+}
+
+// Dials a peer over TCP, on the interface sintf if it is set.
+func (t *tcp) dialTCP(ctx context.Context, saddr string, options *tcpOptions, sintf string) (net.Conn, error) {
+	addrs, err := t.resolve(ctx, saddr, sintf)
+	if err != nil {
+		return nil, err
+	}
+	if options.source != nil && options.source.IP != nil {
+		// Only addresses of the same family can be reached from the source
+		source := options.source.AddrPort().Addr()
+		var reachable []netip.AddrPort
+		for _, addr := range addrs {
+			if addr.Addr().Is4() == source.Is4() {
+				reachable = append(reachable, addr)
 			}
-			if sintf != "" {
-				dialer.Control = t.getControl(sintf)
-				ief, err := net.InterfaceByName(sintf)
-				if err != nil {
-					return
-				}
-				if ief.Flags&net.FlagUp == 0 {
-					return
-				}
-				addrs, err := ief.Addrs()
-				if err == nil {
-					for addrindex, addr := range addrs {
-						src, _, err := net.ParseCIDR(addr.String())
-						if err != nil {
-							continue
-						}
-						if src.Equal(dst.IP) {
-							continue
-						}
-						if !src.IsGlobalUnicast() && !src.IsLinkLocalUnicast() {
-							continue
-						}
-						bothglobal := src.IsGlobalUnicast() == dst.IP.IsGlobalUnicast()
-						bothlinklocal := src.IsLinkLocalUnicast() == dst.IP.IsLinkLocalUnicast()
-						if !bothglobal && !bothlinklocal {
-							continue
-						}
-						if (src.To4() != nil) != (dst.IP.To4() != nil) {
-							continue
-						}
-						if bothglobal || bothlinklocal || addrindex == len(addrs)-1 {
-							dialer.LocalAddr = &net.TCPAddr{
-								IP:   src,
-								Port: 0,
-								Zone: sintf,
-							}
-							break
-						}
-					}
-					if dialer.LocalAddr == nil {
-						return
-					}
+		}
+		if len(reachable) == 0 {
+			return nil, fmt.Errorf("source address %s can't reach any of the addresses of %s", source, saddr)
+		}
+		addrs = reachable
+	}
+	dialer := net.Dialer{
+		Control:         t.tcpContext,
+		KeepAliveConfig: t.keepAliveConfig(),
+	}
+	var ifaddrs []net.Addr
+	if sintf != "" {
+		dialer.Control = t.getControl(sintf)
+		ief, err := net.InterfaceByName(sintf)
+		if err != nil {
+			return nil, err
+		}
+		if ief.Flags&net.FlagUp == 0 {
+			return nil, fmt.Errorf("interface %s is down", sintf)
+		}
+		ifaddrs, _ = ief.Addrs()
+	}
+	delay := dialAttemptDelay
+	if options.source != nil {
+		dialer.LocalAddr = options.source
+		if options.source.Port != 0 {
+			// Only one connection can be made from a port at a time, and the
+			// last one may not have finished closing yet
+			delay = 0
+			control := dialer.Control
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				if err := setReuseAddr(c); err != nil {
+					return err
 				}
+				return control(network, address, c)
 			}
-			ctx, done := context.WithTimeout(t.links.core.ctx, default_timeout)
-			conn, err = dialer.DialContext(ctx, "tcp", dst.String())
-			done()
-			if err != nil {
-				t.links.core.log.Debugf("Failed to dial %s: %s", callproto, err)
-				return
-			}
-			t.waitgroup.Add(1)
-			if ch := t.handler(conn, false, options); ch != nil {
-				<-ch
+		}
+	}
+	conn, addr, err := dialAddresses(ctx, addrs, delay, func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+		dialer := dialer
+		if ifaddrs != nil {
+			src := interfaceSource(ifaddrs, sintf, net.IP(dst.Addr().AsSlice()))
+			if src == nil {
+				return nil, fmt.Errorf("interface %s has no suitable source address", sintf)
 			}
+			dialer.LocalAddr = src
 		}
-	}()
+		return dialer.DialContext(ctx, "tcp", dst.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 1 {
+		t.links.core.log.Debugf("Connected to %s at %s", saddr, addr)
+	}
+	options.dialedAddr = addr.String()
+	return conn, nil
 }
 
-func (t *tcp) handler(sock net.Conn, incoming bool, options tcpOptions) chan struct{} {
+func (t *tcp) handler(sock net.Conn, incoming bool, options tcpOptions) (chan struct{}, error) {
 	defer t.waitgroup.Done() // Happens after sock.close
 	defer sock.Close()
 	t.setExtraOptions(sock)
-	var upgraded bool
+	// Only so many incoming handshakes can be in progress at once, and all of
+	// them have to finish in time, so that connections that never finish them
+	// can't pin the listener down
+	handshakeDone := func() {}
+	if incoming {
+		if !t.accept.startHandshake() {
+			t.dropped(&t.accept.drops.handshakes, sock.RemoteAddr(), sock.LocalAddr(), "too many handshakes in progress")
+			return nil, errors.New("too many handshakes in progress")
+		}
+		handshakeDone = sync.OnceFunc(t.accept.finishHandshake)
+		defer handshakeDone()
+	}
+	deadline := time.Now().Add(t.links.handshakeTimeout)
+	_ = sock.SetDeadline(deadline)
+	if options.proxyProtocol {
+		conn, err := readProxyHeader(sock)
+		if err != nil {
+			if isHandshakeTimeout(err) {
+				t.dropped(&t.accept.drops.timeout, sock.RemoteAddr(), sock.LocalAddr(), "handshake timed out")
+			} else {
+				t.links.core.log.Errorln("Failed to read PROXY protocol header from", sock.RemoteAddr(), ":", err)
+			}
+			return nil, err
+		}
+		sock = conn
+		if !t.admit(sock.RemoteAddr(), sock.LocalAddr(), &options) {
+			return nil, errors.New("connection dropped")
+		}
+	}
 	if options.upgrade != nil {
 		var err error
 		if sock, err = options.upgrade.upgrade(sock, &options); err != nil {
-			t.links.core.log.Errorln("TCP handler upgrade failed:", err)
-			return nil
+			if incoming && isHandshakeTimeout(err) {
+				t.dropped(&t.accept.drops.timeout, sock.RemoteAddr(), sock.LocalAddr(), "handshake timed out")
+			} else {
+				t.links.core.log.Errorln("TCP handler upgrade failed:", err)
+			}
+			t.pinnedKeyRejected(err, &options, sock.LocalAddr().String(), sock.RemoteAddr().String(), incoming)
+			return nil, err
 		}
-		upgraded = true
 	}
+	_ = sock.SetDeadline(time.Time{})
 	var name, proto, local, remote string
-	if options.socksProxyAddr != "" {
-		name = "socks://" + sock.RemoteAddr().String() + "/" + options.socksPeerAddr
-		proto = "socks"
+	switch {
+	case options.connName != "":
+		// The application knows better than we do what the connection is
+		name = options.connName
+		proto = options.linkType()
+		remote = options.connName
+	case options.proxyPeerAddr != "":
+		name = options.proxyScheme + "://" + sock.RemoteAddr().String() + "/" + options.proxyPeerAddr
+		proto = options.proxyScheme
 		local, _, _ = net.SplitHostPort(sock.LocalAddr().String())
-		remote, _, _ = net.SplitHostPort(options.socksPeerAddr)
-	} else {
-		if upgraded {
-			proto = options.upgrade.name
-			name = proto + "://" + sock.RemoteAddr().String()
-		} else {
-			proto = "tcp"
-			name = proto + "://" + sock.RemoteAddr().String()
+		remote, _, _ = net.SplitHostPort(options.proxyPeerAddr)
+	case sock.LocalAddr().Network() == "unix":
+		// UNIX sockets have no host/port, and only the listening end has a
+		// name, so use the socket path to describe both ends of the link. Links
+		// over the same socket are then told apart only by the remote key, so
+		// a second link to the same node over it is refused as a duplicate, in
+		// the same way as TCP links between the same two hosts, whose ports are
+		// left out
+		proto = options.linkType()
+		path := sock.LocalAddr().String()
+		if path == "" || path == "@" {
+			path = sock.RemoteAddr().String()
 		}
+		name = proto + "://" + path
+		local, remote = path, path
+	default:
+		proto = options.linkType()
+		name = proto + "://" + sock.RemoteAddr().String()
 		local, _, _ = net.SplitHostPort(sock.LocalAddr().String())
 		remote, _, _ = net.SplitHostPort(sock.RemoteAddr().String())
 	}
+	// Only links over IP can be tunnelled over Yggdrasil itself, so there is
+	// nothing to check if the local address isn't an IP address, e.g. a path
 	localIP := net.ParseIP(local)
 	if localIP = localIP.To16(); localIP != nil {
 		var laddr address.Address
@@ -402,7 +594,7 @@ func (t *tcp) handler(sock net.Conn, incoming bool, options tcpOptions) chan str
 			//  Maybe dial/listen at the application level
 			//  Then pass a net.Conn to the core library (after these kinds of checks are done)
 			t.links.core.log.Debugln("Dropping ygg-tunneled connection", local, remote)
-			return nil
+			return nil, errors.New("dropping ygg-tunneled connection")
 		}
 	}
 	force := net.ParseIP(strings.Split(remote, "%")[0]).IsLinkLocalUnicast()
@@ -411,8 +603,14 @@ func (t *tcp) handler(sock net.Conn, incoming bool, options tcpOptions) chan str
 		t.links.core.log.Println(err)
 		panic(err)
 	}
+	link.deadline, link.handshakeDone = deadline, handshakeDone
+	link.addr = options.dialedAddr
 	t.links.core.log.Debugln("DEBUG: starting handler for", name)
 	ch, err := link.handler()
 	t.links.core.log.Debugln("DEBUG: stopped handler for", name, err)
-	return ch
+	var timeout handshakeTimeoutError
+	if incoming && errors.As(err, &timeout) {
+		t.dropped(&t.accept.drops.timeout, sock.RemoteAddr(), sock.LocalAddr(), "handshake timed out")
+	}
+	return ch, err
 }
@@ -31,3 +31,15 @@ func (t *tcp) tcpContext(network, address string, c syscall.RawConn) error {
 func (t *tcp) getControl(sintf string) func(string, string, syscall.RawConn) error {
 	return t.tcpContext
 }
+
+// Lets a socket bind to a port that the last connection from it may still be
+// holding while it closes, for peers called with a fixed ?source= port.
+func setReuseAddr(c syscall.RawConn) error {
+	var err error
+	if control := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	}); control != nil {
+		return control
+	}
+	return err
+}
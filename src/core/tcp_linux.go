@@ -5,24 +5,41 @@ package core
 
 import (
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// How long sent data can go unacknowledged before the kernel gives up on the
+// connection, or the read timeout if that is longer. Dead links are already
+// dropped after the read timeout, so this only needs to stop the kernel from
+// retransmitting for many minutes, and is long enough that a stall of a few
+// seconds, e.g. while connecting over a lossy link, doesn't kill a link.
+const tcpUserTimeoutDefault = 30 * time.Second
+
 // WARNING: This context is used both by net.Dialer and net.Listen in tcp.go
 
 func (t *tcp) tcpContext(network, address string, c syscall.RawConn) error {
 	var control error
 	var bbr error
+	var usertimeout error
 
 	control = c.Control(func(fd uintptr) {
 		bbr = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, "bbr")
+		// Give up on the connection if sent data goes unacknowledged for too
+		// long, rather than retransmitting for many minutes
+		// The keepalive socket options are set through Go, see keepAliveConfig
+		timeout := max(tcpUserTimeoutDefault, t.links.readTimeout)
+		usertimeout = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
 	})
 
 	// Log any errors
 	if bbr != nil {
 		t.links.core.log.Debugln("Failed to set tcp_congestion_control to bbr for socket, SetsockoptString error:", bbr)
 	}
+	if usertimeout != nil {
+		t.links.core.log.Debugln("Failed to set TCP_USER_TIMEOUT for socket, SetsockoptInt error:", usertimeout)
+	}
 	if control != nil {
 		t.links.core.log.Debugln("Failed to set tcp_congestion_control to bbr for socket, Control error:", control)
 	}
@@ -44,3 +61,15 @@ func (t *tcp) getControl(sintf string) func(string, string, syscall.RawConn) err
 		return t.tcpContext(network, address, c)
 	}
 }
+
+// Lets a socket bind to a port that the last connection from it may still be
+// holding while it closes, for peers called with a fixed ?source= port.
+func setReuseAddr(c syscall.RawConn) error {
+	var err error
+	if control := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	}); control != nil {
+		return control
+	}
+	return err
+}
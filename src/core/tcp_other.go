@@ -16,3 +16,7 @@ func (t *tcp) tcpContext(network, address string, c syscall.RawConn) error {
 func (t *tcp) getControl(sintf string) func(string, string, syscall.RawConn) error {
 	return t.tcpContext
 }
+
+func setReuseAddr(c syscall.RawConn) error {
+	return nil
+}
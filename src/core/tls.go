@@ -1,18 +1,20 @@
 package core
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
-	"encoding/pem"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,8 +23,21 @@ type tcptls struct {
 	config      *tls.Config
 	forDialer   *TcpUpgrade
 	forListener *TcpUpgrade
+	cert        atomic.Pointer[tls.Certificate] // The current self-signed certificate, replaced by rotate
+	mutex       sync.Mutex                      // Protects timer
+	timer       *time.Timer
 }
 
+var errTLSPinnedKey = errors.New("tls key does not match pinned key")
+
+// How long the self-signed certificate is valid for, how long before it expires
+// that it is replaced, and how often to check whether it's time to do so.
+const (
+	tlsCertLifetime      = 365 * 24 * time.Hour
+	tlsCertRenewBefore   = 30 * 24 * time.Hour
+	tlsCertCheckInterval = time.Hour
+)
+
 func (t *tcptls) init(tcp *tcp) {
 	t.tcp = tcp
 	t.forDialer = &TcpUpgrade{
@@ -34,19 +49,49 @@ func (t *tcptls) init(tcp *tcp) {
 		name:    "tls",
 	}
 
-	edpriv := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
-	copy(edpriv[:], tcp.links.core.secret[:])
+	cert, err := t.generateCertificate()
+	if err != nil {
+		log.Fatalf("Failed to create certificate: %s", err)
+	}
+	t.cert.Store(cert)
 
-	certBuf := &bytes.Buffer{}
+	// The certificate is looked up for each handshake rather than being put in
+	// the config, so that a new one can be swapped in without restarting the
+	// listeners or touching the links that are already up. This also covers
+	// copies of the config, such as those made by configForOptions.
+	t.config = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return t.cert.Load(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return t.cert.Load(), nil
+		},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}
+
+	t.mutex.Lock()
+	t.timer = time.AfterFunc(tlsCertCheckInterval, t.rotate)
+	t.mutex.Unlock()
+}
 
-	// TODO: because NotAfter is finite, we should add some mechanism to regenerate the certificate and restart the listeners periodically for nodes with very high uptimes. Perhaps regenerate certs and restart listeners every few months or so.
+// Creates a new self-signed certificate for our ed25519 key.
+func (t *tcptls) generateCertificate() (*tls.Certificate, error) {
+	edpriv := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+	copy(edpriv[:], t.tcp.links.core.secret[:])
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
 	pubtemp := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			CommonName: hex.EncodeToString(tcp.links.core.public[:]),
+			CommonName: hex.EncodeToString(t.tcp.links.core.public[:]),
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		NotBefore:             now,
+		NotAfter:              now.Add(tlsCertLifetime),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -54,39 +99,88 @@ func (t *tcptls) init(tcp *tcp) {
 
 	derbytes, err := x509.CreateCertificate(rand.Reader, &pubtemp, &pubtemp, edpriv.Public(), edpriv)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derbytes)
+	if err != nil {
+		return nil, err
 	}
+	return &tls.Certificate{
+		Certificate: [][]byte{derbytes},
+		PrivateKey:  edpriv,
+		Leaf:        leaf,
+	}, nil
+}
 
-	if err := pem.Encode(certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: derbytes}); err != nil {
-		panic("failed to encode certificate into PEM")
+// Replaces the certificate if it is close to expiring, and checks again later.
+// Links that are already up aren't affected, since the certificate is only
+// used during the handshake.
+func (t *tcptls) rotate() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer == nil {
+		return // Stopped
+	}
+	if time.Until(t.expiry()) < tlsCertRenewBefore {
+		if cert, err := t.generateCertificate(); err != nil {
+			t.tcp.links.core.log.Errorln("Failed to renew TLS certificate:", err)
+		} else {
+			t.cert.Store(cert)
+			t.tcp.links.core.log.Infoln("Renewed TLS certificate, now valid until", cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
 	}
+	t.timer = time.AfterFunc(tlsCertCheckInterval, t.rotate)
+}
 
-	cpool := x509.NewCertPool()
-	cpool.AppendCertsFromPEM(derbytes)
+// Gets the time at which the current certificate expires.
+func (t *tcptls) expiry() time.Time {
+	return t.cert.Load().Leaf.NotAfter
+}
 
-	t.config = &tls.Config{
-		RootCAs: cpool,
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{derbytes},
-				PrivateKey:  edpriv,
-			},
-		},
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS13,
+// Stops checking whether the certificate needs to be replaced.
+func (t *tcptls) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
 	}
 }
 
+// The checks made on the remote side's certificates are as follows. There must
+// be a self-signed certificate for its ed25519 key, which is normally the only
+// one, but which comes last if the remote side is a listener that has been
+// given a certificate by the operator. The ed25519 key is pinned, or checked
+// against the pinned keys, as usual. The link handshake then checks that the
+// remote side owns that key. If the options ask for verification against the
+// system roots then the first certificate must also be valid for the host name.
 func (t *tcptls) configForOptions(options *tcpOptions) *tls.Config {
 	config := t.config.Clone()
 	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-		if len(rawCerts) != 1 {
-			return errors.New("tls not exactly 1 cert")
+		if len(rawCerts) == 0 {
+			return errors.New("tls no certs")
 		}
-		cert, err := x509.ParseCertificate(rawCerts[0])
-		if err != nil {
-			return errors.New("tls failed to parse cert")
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.New("tls failed to parse cert")
+			}
+			certs = append(certs, cert)
+		}
+		if options.tlsVerifySystem {
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			if _, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       options.tlsVerifyName,
+				Intermediates: intermediates,
+			}); err != nil {
+				return fmt.Errorf("tls failed to verify cert: %w", err)
+			}
 		}
+		cert := certs[len(certs)-1]
 		if cert.PublicKeyAlgorithm != x509.Ed25519 {
 			return errors.New("tls wrong cert algorithm")
 		}
@@ -99,8 +193,9 @@ func (t *tcptls) configForOptions(options *tcpOptions) *tls.Config {
 			options.pinnedEd25519Keys[key] = struct{}{}
 		}
 		if _, isIn := options.pinnedEd25519Keys[key]; !isIn {
-			return errors.New("tls key does not match pinned key")
+			return errTLSPinnedKey
 		}
+		options.keyVerified = true
 		return nil
 	}
 	return config
@@ -108,6 +203,11 @@ func (t *tcptls) configForOptions(options *tcpOptions) *tls.Config {
 
 func (t *tcptls) upgradeListener(c net.Conn, options *tcpOptions) (net.Conn, error) {
 	config := t.configForOptions(options)
+	if keyPair := options.tlsKeyPair; keyPair != nil {
+		config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return keyPair.withCertificate(t.cert.Load())
+		}
+	}
 	conn := tls.Server(c, config)
 	if err := conn.Handshake(); err != nil {
 		return c, err
@@ -124,3 +224,78 @@ func (t *tcptls) upgradeDialer(c net.Conn, options *tcpOptions) (net.Conn, error
 	}
 	return conn, nil
 }
+
+// tlsKeyPair is a certificate and key supplied by the operator for a listener,
+// e.g. one signed by a public CA. The files are loaded again if they change, so
+// that the certificate can be renewed without restarting.
+type tlsKeyPair struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time // The modification time of the newer of the files when they were loaded
+	checked  time.Time // When the files were last checked for changes
+}
+
+// How often to check whether the operator's certificate files have changed.
+const tlsKeyPairCheckInterval = time.Minute
+
+// Loads a certificate and key from the given files.
+func newTLSKeyPair(certFile, keyFile string) (*tlsKeyPair, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both cert and key must be given")
+	}
+	k := &tlsKeyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := k.get(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Gets the certificate, loading it again if the files have changed. If they
+// can't be loaded then the last certificate that could be is used instead.
+func (k *tlsKeyPair) get() (*tls.Certificate, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.cert != nil && time.Since(k.checked) < tlsKeyPairCheckInterval {
+		return k.cert, nil
+	}
+	k.checked = time.Now()
+	var modTime time.Time
+	for _, file := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if k.cert != nil {
+				return k.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if k.cert != nil && !modTime.After(k.modTime) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	k.cert, k.modTime = &cert, modTime
+	return k.cert, nil
+}
+
+// Gets the operator's certificate chain with our own self-signed certificate on
+// the end, so that the remote side can still find our ed25519 key.
+func (k *tlsKeyPair) withCertificate(own *tls.Certificate) (*tls.Certificate, error) {
+	cert, err := k.get()
+	if err != nil {
+		return nil, err
+	}
+	chain := *cert
+	chain.Certificate = append(append([][]byte(nil), cert.Certificate...), own.Certificate...)
+	return &chain, nil
+}
@@ -0,0 +1,458 @@
+package core
+
+// This is the registry of link types, which maps the scheme of each peer and
+// listener URI to the code that dials or listens for it. Applications that
+// embed the core can add their own with RegisterTransport, e.g. to carry links
+// over a relay that is built into the application. The built-in link types are
+// registered in the same way when the node starts, so that every link goes
+// through the same code whatever carries it.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// Transport carries links for a URI scheme of its own. Peer and listener URIs
+// with that scheme are passed to Dial and Listen, and the link handshake then
+// runs over the connections as usual. Query parameters that apply to all
+// links, such as ?key= and ?maxrate=, are handled by the core, and are still
+// present in the URI so that the transport can ignore them.
+type Transport interface {
+	// Dial connects to the peer at the given URI, giving up once the context
+	// is done.
+	Dial(ctx context.Context, u *url.URL) (net.Conn, error)
+	// Listen starts listening for connections at the given URI. The listener
+	// is closed when it is stopped or when the node stops.
+	Listen(u *url.URL) (net.Listener, error)
+}
+
+// linkConfigurer is implemented by the built-in transports, which need more
+// from the core than a connection, such as having their links upgraded to TLS.
+type linkConfigurer interface {
+	// Sets the options for calling the peer at u, and returns the address to
+	// call it at, which Dial finds in linkCallFrom.
+	configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error)
+	// Sets the options for the links of a listener at u.
+	configureListen(u *url.URL, options *tcpOptions) error
+}
+
+// linkCall is what a built-in transport needs to know to dial a peer, beyond
+// its URI, and is passed to Dial in the context.
+type linkCall struct {
+	addr    string
+	options *tcpOptions
+	sintf   string
+}
+
+type linkCallKey struct{}
+
+func linkCallFrom(ctx context.Context) (*linkCall, error) {
+	if call, ok := ctx.Value(linkCallKey{}).(*linkCall); ok {
+		return call, nil
+	}
+	return nil, errors.New("built-in transports can only be dialed by the core")
+}
+
+// Checks that a peer isn't being called on a specific interface, for link
+// types that can't do that.
+func noInterface(u *url.URL, sintf string) error {
+	if sintf != "" {
+		return fmt.Errorf("%s peers can't be called on a specific interface", u.Scheme)
+	}
+	return nil
+}
+
+// The built-in link types, which can't be replaced.
+func (t *tcp) builtinTransports() map[string]Transport {
+	return map[string]Transport{
+		"tcp":        &tcpTransport{t},
+		"tls":        &tlsTransport{tcpTransport{t}},
+		"obfs":       &obfsTransport{tcpTransport{t}},
+		"quic":       &quicTransport{t},
+		"ws":         &wsTransport{t},
+		"wss":        &wssTransport{wsTransport{t}},
+		"unix":       &unixTransport{t},
+		"socks":      &socksTransport{t},
+		"http-proxy": &httpProxyTransport{t},
+	}
+}
+
+// Finds the link type for a scheme.
+func (t *tcp) transport(scheme string) (Transport, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	transport, isIn := t.transports[scheme]
+	return transport, isIn
+}
+
+// Adds a link type for a scheme from RegisterTransport, which mustn't be built
+// in or already have one.
+func (t *tcp) registerTransport(scheme string, tr Transport) error {
+	if _, isIn := t.builtinTransports()[scheme]; isIn {
+		return fmt.Errorf("scheme %s is built in", scheme)
+	}
+	return t.addTransport(scheme, tr)
+}
+
+func (t *tcp) addTransport(scheme string, tr Transport) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, isIn := t.transports[scheme]; isIn {
+		return fmt.Errorf("scheme %s is already registered", scheme)
+	}
+	if t.transports == nil {
+		t.transports = make(map[string]Transport)
+	}
+	t.transports[scheme] = tr
+	return nil
+}
+
+// Calls the peer at u over the transport for its scheme.
+func (l *links) callTransport(u *url.URL, options tcpOptions, sintf string) error {
+	tr, ok := l.tcp.transport(u.Scheme)
+	if !ok {
+		return errors.New("unknown call scheme: " + u.Scheme)
+	}
+	options.proto = u.Scheme
+	saddr := u.String()
+	if c, ok := tr.(linkConfigurer); ok {
+		var err error
+		if saddr, err = c.configureCall(u, &options, sintf); err != nil {
+			return err
+		}
+	} else if err := noInterface(u, sintf); err != nil {
+		return err
+	}
+	options.dial = func(ctx context.Context, saddr string, o *tcpOptions) (net.Conn, error) {
+		return tr.Dial(context.WithValue(ctx, linkCallKey{}, &linkCall{saddr, o, sintf}), u)
+	}
+	l.tcp.call(saddr, options, sintf)
+	return nil
+}
+
+// Starts a listener at u with the transport for its scheme. The host and port
+// to listen on are given separately, since they include the interface for
+// link-local addresses.
+func (t *tcp) listenTransport(u *url.URL, hostport string, options tcpOptions) (*TcpListener, error) {
+	tr, ok := t.transport(u.Scheme)
+	if !ok {
+		t.links.core.log.Errorln("Failed to add listener: listener", u.String(), "is not correctly formatted, ignoring")
+		return nil, nil
+	}
+	options.proto = u.Scheme
+	lu := *u
+	lu.Host = hostport
+	if c, ok := tr.(linkConfigurer); ok {
+		if err := c.configureListen(&lu, &options); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := tr.Listen(&lu)
+	if err != nil {
+		return nil, err
+	}
+	l := TcpListener{
+		Listener: listener,
+		opts:     options,
+		stop:     make(chan struct{}),
+	}
+	t.waitgroup.Add(1)
+	go t.listener(&l, u.Scheme+"://"+hostport+u.Path)
+	return &l, nil
+}
+
+// tcpTransport carries tcp:// links, and is the base of the other link types
+// that run over a TCP connection to the peer.
+type tcpTransport struct {
+	tcp *tcp
+}
+
+func (tr *tcpTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialTCP(ctx, call.addr, call.options, call.sintf)
+}
+
+func (tr *tcpTransport) Listen(u *url.URL) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control:         tr.tcp.tcpContext,
+		KeepAliveConfig: tr.tcp.keepAliveConfig(),
+	}
+	return lc.Listen(tr.tcp.links.core.ctx, "tcp", u.Host)
+}
+
+func (tr *tcpTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	return u.Host, nil
+}
+
+func (tr *tcpTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
+
+// tlsTransport carries tls:// links, which are TCP connections upgraded to TLS.
+type tlsTransport struct {
+	tcpTransport
+}
+
+func (tr *tlsTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	options.upgrade = tr.tcp.tls.forDialer
+	if err := configureTLSCall(u, options); err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+func (tr *tlsTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	options.upgrade = tr.tcp.tls.forListener
+	if q := u.Query(); q.Get("cert") != "" || q.Get("key") != "" {
+		var err error
+		if options.tlsKeyPair, err = newTLSKeyPair(q.Get("cert"), q.Get("key")); err != nil {
+			return fmt.Errorf("failed to load certificate for listener %s: %w", u.String(), err)
+		}
+	}
+	return nil
+}
+
+// Sets the TLS options for calling tls:// and quic:// peers.
+func configureTLSCall(u *url.URL, options *tcpOptions) error {
+	// SNI headers must contain hostnames and not IP addresses, so we must make sure
+	// that we do not populate the SNI with an IP literal. We do this by splitting
+	// the host-port combo from the query option and then seeing if it parses to an
+	// IP address successfully or not.
+	if sni := u.Query().Get("sni"); sni != "" {
+		if net.ParseIP(sni) == nil {
+			options.tlsSNI = sni
+		}
+	}
+	// If the SNI is not configured still because the above failed then we'll try
+	// again but this time we'll use the host part of the peering URI instead.
+	if options.tlsSNI == "" {
+		if host, _, err := net.SplitHostPort(u.Host); err == nil && net.ParseIP(host) == nil {
+			options.tlsSNI = host
+		}
+	}
+	// The remote side's certificate can be checked against the system roots,
+	// for listeners that have been given a CA-signed certificate
+	switch verify := u.Query().Get("verify"); verify {
+	case "":
+	case "system":
+		options.tlsVerifySystem = true
+		options.tlsVerifyName = options.tlsSNI
+		if options.tlsVerifyName == "" {
+			options.tlsVerifyName, _, _ = net.SplitHostPort(u.Host)
+		}
+	default:
+		return fmt.Errorf("peer %s is not correctly formatted (unknown verify option %q)", u.String(), verify)
+	}
+	return nil
+}
+
+// obfsTransport carries obfs:// links, which must be called with exactly one
+// pinned key, since the traffic is obfuscated with it.
+type obfsTransport struct {
+	tcpTransport
+}
+
+func (tr *obfsTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if len(options.pinnedEd25519Keys) != 1 {
+		return "", fmt.Errorf("peer %s is not correctly formatted (obfs peers need exactly one ?key=)", u.String())
+	}
+	options.upgrade = tr.tcp.obfs.forDialer
+	return u.Host, nil
+}
+
+func (tr *obfsTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	options.upgrade = tr.tcp.obfs.forListener
+	return nil
+}
+
+// quicTransport carries quic:// links, see quic.go.
+type quicTransport struct {
+	tcp *tcp
+}
+
+func (tr *quicTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialQUIC(ctx, call.addr, call.options)
+}
+
+func (tr *quicTransport) Listen(u *url.URL) (net.Listener, error) {
+	return tr.tcp.listenQUIC(u.Host)
+}
+
+func (tr *quicTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if err := noInterface(u, sintf); err != nil {
+		return "", err
+	}
+	if err := configureTLSCall(u, options); err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+func (tr *quicTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
+
+// wsTransport carries ws:// links, see ws.go.
+type wsTransport struct {
+	tcp *tcp
+}
+
+func (tr *wsTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialWS(ctx, call.addr, call.options)
+}
+
+func (tr *wsTransport) Listen(u *url.URL) (net.Listener, error) {
+	return tr.tcp.listenWS(u)
+}
+
+func (tr *wsTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if err := noInterface(u, sintf); err != nil {
+		return "", err
+	}
+	// Query parameters such as the pinned keys are only for us, so don't
+	// send them on to the remote HTTP server.
+	wsURL := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	return wsURL.String(), nil
+}
+
+func (tr *wsTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
+
+// wssTransport carries wss:// links, which can only be called.
+type wssTransport struct {
+	wsTransport
+}
+
+func (tr *wssTransport) Listen(u *url.URL) (net.Listener, error) {
+	return nil, fmt.Errorf("listener %s is not supported, use a ws:// listener behind a TLS-terminating reverse proxy instead", u.Scheme+"://"+u.Host+u.Path)
+}
+
+// unixTransport carries unix:// links, see unix.go.
+type unixTransport struct {
+	tcp *tcp
+}
+
+func (tr *unixTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialUNIX(ctx, call.addr, call.options)
+}
+
+func (tr *unixTransport) Listen(u *url.URL) (net.Listener, error) {
+	return tr.tcp.listenUNIX(u.Path)
+}
+
+func (tr *unixTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if err := noInterface(u, sintf); err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+func (tr *unixTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
+
+// socksTransport calls socks:// peers through a SOCKS5 proxy, which can't be
+// listened on.
+type socksTransport struct {
+	tcp *tcp
+}
+
+func (tr *socksTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialSOCKS(ctx, call.addr, call.options)
+}
+
+func (tr *socksTransport) Listen(u *url.URL) (net.Listener, error) {
+	return nil, fmt.Errorf("listener %s is not supported, %s:// can only be used for peers", u.Scheme+"://"+u.Host, u.Scheme)
+}
+
+func (tr *socksTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if err := noInterface(u, sintf); err != nil {
+		return "", err
+	}
+	options.socksProxyAddr = u.Host
+	if u.User != nil {
+		options.socksProxyAuth = &proxy.Auth{}
+		options.socksProxyAuth.User = u.User.Username()
+		options.socksProxyAuth.Password, _ = u.User.Password()
+	}
+	options.proxyScheme = u.Scheme
+	options.proto = ""
+	options.upgrade = tr.tcp.tls.forDialer // TODO make this configurable
+	pathtokens := strings.Split(strings.Trim(u.Path, "/"), "/")
+	return pathtokens[0], nil
+}
+
+func (tr *socksTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
+
+// httpProxyTransport calls http-proxy:// peers through an HTTP proxy, see
+// httpproxy.go, and can't be listened on.
+type httpProxyTransport struct {
+	tcp *tcp
+}
+
+func (tr *httpProxyTransport) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	call, err := linkCallFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.tcp.dialHTTPProxy(ctx, call.addr, call.options)
+}
+
+func (tr *httpProxyTransport) Listen(u *url.URL) (net.Listener, error) {
+	return nil, fmt.Errorf("listener %s is not supported, %s:// can only be used for peers", u.Scheme+"://"+u.Host, u.Scheme)
+}
+
+func (tr *httpProxyTransport) configureCall(u *url.URL, options *tcpOptions, sintf string) (string, error) {
+	if err := noInterface(u, sintf); err != nil {
+		return "", err
+	}
+	options.httpProxyAddr = u.Host
+	options.httpProxyAuth = u.User
+	options.proxyScheme = u.Scheme
+	options.proto = ""
+	peeraddr := strings.Split(strings.Trim(u.Path, "/"), "/")[0]
+	if _, _, err := net.SplitHostPort(peeraddr); err != nil {
+		return "", fmt.Errorf("peer %s is not correctly formatted (%s)", u.String(), err)
+	}
+	switch strings.ToLower(u.Query().Get("tls")) {
+	case "0", "false", "no":
+	default:
+		options.upgrade = tr.tcp.tls.forDialer
+		if host, _, _ := net.SplitHostPort(peeraddr); net.ParseIP(host) == nil {
+			options.tlsSNI = host
+		}
+	}
+	return peeraddr, nil
+}
+
+func (tr *httpProxyTransport) configureListen(u *url.URL, options *tcpOptions) error {
+	return nil
+}
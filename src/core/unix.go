@@ -0,0 +1,44 @@
+package core
+
+// This adds UNIX domain sockets as a link type, which is useful for peering
+// nodes that run on the same host, e.g. in separate containers that share a
+// volume, without exposing any TCP ports. Peer and listener URIs take the form
+// unix:///path/to/socket. The connections have no addresses beyond the path,
+// so only one link to each node can be made over a socket.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+func (t *tcp) listenUNIX(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("unix listener requires a socket path")
+	}
+	// If the socket already exists then either another process is listening
+	// on it, or it was left behind by a previous run that didn't exit cleanly.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			// Probably a typo in the URI, so don't touch it
+			return nil, errors.New(path + " already exists and is not a unix socket")
+		}
+		if conn, err := net.DialTimeout("unix", path, 2*time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("unix socket " + path + " is already in use")
+		}
+		t.links.core.log.Debugln("UNIX socket", path, "already exists, trying to clean up")
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	var lc net.ListenConfig
+	return lc.Listen(t.links.core.ctx, "unix", path)
+}
+
+func (t *tcp) dialUNIX(ctx context.Context, path string, options *tcpOptions) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", path)
+}
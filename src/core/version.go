@@ -4,65 +4,273 @@ package core
 // Used in the initial connection setup and key exchange
 // Some of this could arguably go in wire.go instead
 
-import "crypto/ed25519"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
 
 // This is the version-specific metadata exchanged at the start of a connection.
 // It must always begin with the 4 bytes "meta" and a wire formatted uint64 major version number.
-// The current version also includes a minor version number, and the box/sig/link keys that need to be exchanged to open a connection.
+// The current version also includes a minor version number, and then the length of the rest of the metadata, so that it can be read even if it comes from a newer version.
+// The rest of the metadata is a list of type-length-value fields, and fields with an unknown type are skipped, so that newer versions can add fields without breaking older ones.
+// Once both sides have exchanged metadata, each side signs the nonce that the other side sent, along with the metadata of both sides, which proves that it holds the private key for the key it claims and that the metadata arrived unchanged.
 type version_metadata struct {
 	meta [4]byte
 	ver  uint8 // 1 byte in this version
 	// Everything after this point potentially depends on the version number, and is subject to change in future versions
-	minorVer uint8 // 1 byte in this version
-	key      ed25519.PublicKey
+	minorVer     uint8 // 1 byte in this version
+	minMinorVer  uint8 // The oldest minor version that this side can still talk to
+	key          ed25519.PublicKey
+	nonce        [version_nonceSize]byte
+	capabilities version_capabilities
+	readTimeout  uint32 // How long this side waits to hear from the other before dropping the link, in milliseconds, 0 if it didn't say
+}
+
+// Metadata field types.
+const (
+	metaKey          = 1 // ed25519.PublicKey
+	metaNonce        = 2 // [version_nonceSize]byte
+	metaMinMinorVer  = 3 // uint8
+	metaCapabilities = 4 // uint32, big endian
+	metaReadTimeout  = 5 // uint32 milliseconds, big endian
+)
+
+// The minor version of the 0.4 releases, whose metadata is just the start of the header followed by the key, and which don't sign anything.
+// Links to these are still accepted for now, unless their key would need to be proven, so that a network can be upgraded one node at a time.
+const version_legacyMinorVer = 4
+
+// The size of the nonce that the remote side is challenged to sign.
+const version_nonceSize = 32
+
+// A prefix for signed handshake messages, so that a signature made during the handshake can't be mistaken for one made for any other purpose.
+const version_signaturePrefix = "yggdrasil link handshake"
+
+// version_capabilities is a set of optional link features. Each side sends the capabilities that it supports, and a link uses the capabilities that both sides support.
+type version_capabilities uint32
+
+// The known capabilities.
+const (
+	version_capPing      version_capabilities = 1 << iota // Links can be pinged to measure round-trip time, see ping.go
+	version_capKeepAlive                                  // Keepalives are sent often enough for the read timeout that the other side sent, see link.keepAliveTimes
+)
+
+// The names of the known capabilities, in bit order, used for logging.
+var version_capabilityNames = []string{"ping", "keepalive"}
+
+// Gets the capabilities that are supported by this version.
+func version_getCapabilities() version_capabilities {
+	var caps version_capabilities
+	for i := range version_capabilityNames {
+		caps |= 1 << i
+	}
+	return caps
+}
+
+// Checks if all of the given capabilities are in the set.
+func (c version_capabilities) has(caps version_capabilities) bool {
+	return c&caps == caps
+}
+
+func (c version_capabilities) String() string {
+	var names []string
+	for i, name := range version_capabilityNames {
+		if c.has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
 }
 
 // Gets a base metadata with no keys set, but with the correct version numbers.
 func version_getBaseMetadata() version_metadata {
 	return version_metadata{
-		meta:     [4]byte{'m', 'e', 't', 'a'},
-		ver:      0,
-		minorVer: 4,
+		meta:         [4]byte{'m', 'e', 't', 'a'},
+		ver:          0,
+		minorVer:     5,
+		minMinorVer:  5,
+		capabilities: version_getCapabilities(),
 	}
 }
 
-// Gets the length of the metadata for this version, used to know how many bytes to read from the start of a connection.
-func version_getMetaLength() (mlen int) {
-	mlen += 4                     // meta
-	mlen++                        // ver, as long as it's < 127, which it is in this version
-	mlen++                        // minorVer, as long as it's < 127, which it is in this version
-	mlen += ed25519.PublicKeySize // key
+// Gets the length of the part of the metadata that is the same in every version, which is enough to read the version numbers.
+func version_getPrefixLength() (mlen int) {
+	mlen += 4 // meta
+	mlen++    // ver, as long as it's < 127, which it is in this version
+	mlen++    // minorVer, as long as it's < 127, which it is in this version
 	return
 }
 
+// Gets the length of the start of the metadata, which is enough to read the version numbers and the length of the rest.
+func version_getHeaderLength() (mlen int) {
+	mlen += version_getPrefixLength()
+	mlen += 2 // length of the fields that follow
+	return
+}
+
+// Fills in the nonce with random bytes.
+func (m *version_metadata) randomise() error {
+	_, err := rand.Read(m.nonce[:])
+	return err
+}
+
 // Encodes version metadata into its wire format.
 func (m *version_metadata) encode() []byte {
-	bs := make([]byte, 0, version_getMetaLength())
-	bs = append(bs, m.meta[:]...)
-	bs = append(bs, m.ver)
-	bs = append(bs, m.minorVer)
-	bs = append(bs, m.key[:]...)
-	if len(bs) != version_getMetaLength() {
-		panic("Inconsistent metadata length")
+	bs := make([]byte, version_getHeaderLength())
+	copy(bs, m.meta[:])
+	bs[4] = m.ver
+	bs[5] = m.minorVer
+	field := func(t uint8, v []byte) {
+		bs = append(bs, t)
+		bs = binary.BigEndian.AppendUint16(bs, uint16(len(v)))
+		bs = append(bs, v...)
+	}
+	field(metaKey, m.key)
+	field(metaNonce, m.nonce[:])
+	field(metaMinMinorVer, []byte{m.minMinorVer})
+	field(metaCapabilities, binary.BigEndian.AppendUint32(nil, uint32(m.capabilities)))
+	if m.readTimeout != 0 {
+		field(metaReadTimeout, binary.BigEndian.AppendUint32(nil, m.readTimeout))
 	}
+	binary.BigEndian.PutUint16(bs[6:], uint16(len(bs)-version_getHeaderLength()))
 	return bs
 }
 
-// Decodes version metadata from its wire format into the struct.
-func (m *version_metadata) decode(bs []byte) bool {
-	if len(bs) != version_getMetaLength() {
+// Encodes version metadata into the wire format of the 0.4 releases, for legacy peers.
+func (m *version_metadata) encodeLegacy() []byte {
+	bs := make([]byte, 0, version_getPrefixLength()+ed25519.PublicKeySize)
+	bs = append(bs, m.meta[:]...)
+	bs = append(bs, m.ver, version_legacyMinorVer)
+	bs = append(bs, m.key...)
+	return bs
+}
+
+// Decodes the version numbers from the start of the metadata.
+func (m *version_metadata) decodePrefix(bs []byte) bool {
+	if len(bs) != version_getPrefixLength() {
 		return false
 	}
-	offset := 0
-	offset += copy(m.meta[:], bs[offset:])
-	m.ver, offset = bs[offset], offset+1
-	m.minorVer, offset = bs[offset], offset+1
-	m.key = append([]byte(nil), bs[offset:]...)
+	copy(m.meta[:], bs)
+	m.ver = bs[4]
+	m.minorVer = bs[5]
 	return true
 }
 
-// Checks that the "meta" bytes and the version numbers are the expected values.
+// Decodes the header from the start of the metadata, and returns the length of the fields that follow it.
+func (m *version_metadata) decodeHeader(bs []byte) (int, bool) {
+	if len(bs) != version_getHeaderLength() || !m.decodePrefix(bs[:version_getPrefixLength()]) {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(bs[version_getPrefixLength():])), true
+}
+
+// Checks if the metadata is from a 0.4 release, in which case the key follows the version numbers, and nothing else.
+func (m *version_metadata) isLegacy() bool {
+	base := version_getBaseMetadata()
+	return base.meta == m.meta && base.ver == m.ver && m.minorVer == version_legacyMinorVer
+}
+
+// Decodes the fields that follow the header into the struct.
+func (m *version_metadata) decode(bs []byte) bool {
+	for len(bs) > 0 {
+		if len(bs) < 3 {
+			return false
+		}
+		t, l := bs[0], int(binary.BigEndian.Uint16(bs[1:3]))
+		if len(bs) < 3+l {
+			return false
+		}
+		v := bs[3 : 3+l]
+		bs = bs[3+l:]
+		switch t {
+		case metaKey:
+			if l != ed25519.PublicKeySize {
+				return false
+			}
+			m.key = append([]byte(nil), v...)
+		case metaNonce:
+			if l != version_nonceSize {
+				return false
+			}
+			copy(m.nonce[:], v)
+		case metaMinMinorVer:
+			if l != 1 {
+				return false
+			}
+			m.minMinorVer = v[0]
+		case metaCapabilities:
+			if l != 4 {
+				return false
+			}
+			m.capabilities = version_capabilities(binary.BigEndian.Uint32(v))
+		case metaReadTimeout:
+			if l != 4 {
+				return false
+			}
+			m.readTimeout = binary.BigEndian.Uint32(v)
+		default:
+			// Added by a newer version, so we don't know what to do with it
+		}
+	}
+	return m.key != nil
+}
+
+// Checks that the "meta" bytes and the major version number are the expected values, and that the minor version number is one that we still support.
+// This only needs the header, so that we can give up without reading the rest if the remote side is too old.
+func (m *version_metadata) checkHeader() bool {
+	base := version_getBaseMetadata()
+	return base.meta == m.meta && base.ver == m.ver && m.minorVer >= base.minMinorVer
+}
+
+// Checks that the remote side can talk to us, i.e. that our minor version number is one that it still supports.
 func (m *version_metadata) check() bool {
 	base := version_getBaseMetadata()
-	return base.meta == m.meta && base.ver == m.ver && base.minorVer == m.minorVer
+	return m.checkHeader() && base.minorVer >= m.minMinorVer
+}
+
+// Gets the highest minor version and the set of capabilities supported by both sides.
+func (m *version_metadata) negotiate(remote *version_metadata) (uint8, version_capabilities) {
+	minorVer := m.minorVer
+	if remote.minorVer < minorVer {
+		minorVer = remote.minorVer
+	}
+	return minorVer, m.capabilities & remote.capabilities
+}
+
+// Gets a human readable version string, e.g. for logging.
+func (m *version_metadata) version() string {
+	return fmt.Sprintf("%d.%d", m.ver, m.minorVer)
+}
+
+// Gets the message that the signer signs to answer the verifier's challenge.
+// It covers both keys, so that the signature is only valid for this pair of nodes, and the versions, capabilities and read timeout that each side advertised, as the signer saw them, so that they can't be changed in transit to make the link use an older version or fewer capabilities than both sides support.
+func version_getSigningMessage(signer, verifier *version_metadata) []byte {
+	msg := make([]byte, 0, len(version_signaturePrefix)+version_nonceSize+2*(ed25519.PublicKeySize+10))
+	msg = append(msg, version_signaturePrefix...)
+	msg = append(msg, verifier.nonce[:]...)
+	for _, m := range []*version_metadata{signer, verifier} {
+		msg = append(msg, m.key...)
+		msg = append(msg, m.minorVer, m.minMinorVer)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(m.capabilities))
+		msg = binary.BigEndian.AppendUint32(msg, m.readTimeout)
+	}
+	return msg
+}
+
+// Signs the nonce that the remote side sent us, to prove that we own our key.
+func (m *version_metadata) sign(priv ed25519.PrivateKey, remote *version_metadata) []byte {
+	return ed25519.Sign(priv, version_getSigningMessage(m, remote))
+}
+
+// Checks the signature that the remote side sent back in response to our nonce.
+func (m *version_metadata) verify(remote *version_metadata, sig []byte) bool {
+	if len(remote.key) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(remote.key, version_getSigningMessage(remote, m), sig)
 }
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+)
+
+func encodeDecode(t *testing.T, bs []byte) version_metadata {
+	var m version_metadata
+	length, ok := m.decodeHeader(bs[:version_getHeaderLength()])
+	if !ok {
+		t.Fatal("failed to decode header")
+	}
+	if length != len(bs)-version_getHeaderLength() {
+		t.Fatal("unexpected metadata length", length)
+	}
+	if !m.decode(bs[version_getHeaderLength():]) {
+		t.Fatal("failed to decode metadata")
+	}
+	return m
+}
+
+// TestVersion_EncodeDecode checks that metadata survives a round trip, and
+// that fields added by newer versions are skipped.
+func TestVersion_EncodeDecode(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := version_getBaseMetadata()
+	base.key = pub
+	base.capabilities = 0x5
+	if err = base.randomise(); err != nil {
+		t.Fatal(err)
+	}
+	bs := base.encode()
+	m := encodeDecode(t, bs)
+	if !bytes.Equal(m.key, base.key) || m.nonce != base.nonce ||
+		m.minorVer != base.minorVer || m.minMinorVer != base.minMinorVer ||
+		m.capabilities != base.capabilities {
+		t.Fatal("metadata did not survive a round trip")
+	}
+	if !m.check() {
+		t.Fatal("metadata from this version should be compatible")
+	}
+
+	bs = append(bs, 0xff, 0, 3, 1, 2, 3)
+	binary.BigEndian.PutUint16(bs[6:], uint16(len(bs)-version_getHeaderLength()))
+	if m = encodeDecode(t, bs); !bytes.Equal(m.key, base.key) {
+		t.Fatal("unknown field was not skipped")
+	}
+
+	if m.decode(bs[version_getHeaderLength() : len(bs)-1]) {
+		t.Fatal("truncated metadata should not decode")
+	}
+}
+
+// TestVersion_Negotiate checks that the range of supported versions is
+// respected and that only common capabilities are used.
+func TestVersion_Negotiate(t *testing.T) {
+	base := version_getBaseMetadata()
+	base.capabilities = 0x3
+
+	newer := version_getBaseMetadata()
+	newer.minorVer = base.minorVer + 1
+	newer.minMinorVer = base.minorVer
+	newer.capabilities = 0x6
+	if !newer.check() {
+		t.Fatal("newer version which supports us should be compatible")
+	}
+	minorVer, caps := base.negotiate(&newer)
+	if minorVer != base.minorVer {
+		t.Fatal("unexpected negotiated version", minorVer)
+	}
+	if caps != 0x2 {
+		t.Fatal("unexpected negotiated capabilities", caps)
+	}
+
+	newer.minMinorVer = base.minorVer + 1
+	if newer.check() {
+		t.Fatal("newer version which doesn't support us should be incompatible")
+	}
+
+	older := version_getBaseMetadata()
+	older.minorVer = base.minMinorVer - 1
+	if older.checkHeader() {
+		t.Fatal("older unsupported version should be incompatible")
+	}
+}
+
+// TestVersion_Sign checks that a signature only verifies if both sides saw the
+// same metadata, so that the versions and capabilities can't be downgraded in
+// transit.
+func TestVersion_Sign(t *testing.T) {
+	newMetadata := func() (version_metadata, ed25519.PrivateKey) {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := version_getBaseMetadata()
+		m.key = pub
+		if err = m.randomise(); err != nil {
+			t.Fatal(err)
+		}
+		return m, priv
+	}
+	a, privA := newMetadata()
+	b, _ := newMetadata()
+	sig := a.sign(privA, &b)
+	if !b.verify(&a, sig) {
+		t.Fatal("signature did not verify")
+	}
+
+	b.nonce[0] ^= 1
+	if b.verify(&a, sig) {
+		t.Fatal("signature verified for a different nonce")
+	}
+	b.nonce[0] ^= 1
+
+	for name, tamper := range map[string]func(m *version_metadata){
+		"minorVer":     func(m *version_metadata) { m.minorVer-- },
+		"minMinorVer":  func(m *version_metadata) { m.minMinorVer-- },
+		"capabilities": func(m *version_metadata) { m.capabilities = 0 },
+	} {
+		// What B received from A, or what A received from B, was changed
+		for _, tampered := range []*version_metadata{&a, &b} {
+			saved := *tampered
+			tamper(tampered)
+			if b.verify(&a, sig) {
+				t.Fatal("signature verified with changed", name)
+			}
+			*tampered = saved
+		}
+	}
+}
+
+// TestVersion_Capabilities checks that capabilities which only one side knows
+// about, or which a side doesn't send at all, are left out of the link.
+func TestVersion_Capabilities(t *testing.T) {
+	base := version_getBaseMetadata()
+	if !base.capabilities.has(version_capPing | version_capKeepAlive) {
+		t.Fatal("known capabilities are not advertised:", base.capabilities)
+	}
+
+	// A newer version with a capability that we don't know about
+	const unknown version_capabilities = 1 << 31
+	newer := version_getBaseMetadata()
+	newer.capabilities = version_capPing | unknown
+	if _, caps := base.negotiate(&newer); caps != version_capPing {
+		t.Fatal("unexpected negotiated capabilities", caps)
+	}
+	if s := unknown.String(); s != "none" {
+		t.Fatal("unknown capability should not be named, got", s)
+	}
+
+	// A version that doesn't send any capabilities
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []byte
+	fields = append(fields, metaKey, 0, ed25519.PublicKeySize)
+	fields = append(fields, pub...)
+	fields = append(fields, metaNonce, 0, version_nonceSize)
+	fields = append(fields, make([]byte, version_nonceSize)...)
+	var older version_metadata
+	if !older.decode(fields) {
+		t.Fatal("metadata without capabilities should decode")
+	}
+	older.meta, older.ver, older.minorVer = base.meta, base.ver, base.minorVer
+	if !older.check() {
+		t.Fatal("metadata without capabilities should be compatible")
+	}
+	if _, caps := base.negotiate(&older); caps != 0 {
+		t.Fatal("unexpected negotiated capabilities", caps)
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+// This adds WebSockets as a link type, so that links can be carried through
+// HTTP(S) infrastructure such as forward proxies and reverse proxies. Each
+// link is a single WebSocket connection carrying binary messages, which is
+// presented to the rest of the link code as a net.Conn.
+//
+// Outgoing ws:// and wss:// connections honour the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables. Incoming connections are only accepted
+// on ws:// listeners, which are expected to sit behind a TLS-terminating
+// reverse proxy such as nginx if wss:// is wanted. A wss:// listener is
+// refused with an error rather than silently ignored.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+const wsSubprotocol = "ygg-ws"
+
+// wsConn overrides the addresses reported by a WebSocket net.Conn, which would
+// otherwise be meaningless for outgoing connections or point at the reverse
+// proxy for incoming ones.
+type wsConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// wsListener adapts an HTTP server, which upgrades requests for the configured
+// path to WebSocket connections, to a net.Listener.
+type wsListener struct {
+	tcp        *tcp
+	listener   net.Listener
+	server     *http.Server
+	path       string
+	trustProxy bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	conns      chan net.Conn
+}
+
+func (t *tcp) listenWS(u *url.URL) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control:         t.tcpContext,
+		KeepAliveConfig: t.keepAliveConfig(),
+	}
+	listener, err := lc.Listen(t.links.core.ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	wl := &wsListener{
+		tcp:      t,
+		listener: listener,
+		path:     u.Path,
+		conns:    make(chan net.Conn),
+	}
+	if wl.path == "" {
+		wl.path = "/"
+	}
+	// Only believe X-Forwarded-For and X-Real-IP if we have been told that
+	// there is a reverse proxy in front of us, otherwise anyone could claim
+	// to be connecting from anywhere.
+	switch strings.ToLower(u.Query().Get("trustproxy")) {
+	case "1", "true", "yes":
+		wl.trustProxy = true
+	}
+	wl.ctx, wl.cancel = context.WithCancel(t.links.core.ctx)
+	wl.server = &http.Server{
+		Handler:           wl,
+		ReadHeaderTimeout: default_timeout,
+	}
+	go func() {
+		defer wl.cancel()
+		_ = wl.server.Serve(listener)
+	}()
+	return wl, nil
+}
+
+// Upgrades incoming HTTP requests for our path and hands them to Accept.
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: []string{wsSubprotocol},
+		// The link handshake authenticates the remote node, and browsers
+		// are not expected to connect, so don't enforce same-origin.
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		l.tcp.links.core.log.Debugln("Failed to accept WebSocket connection:", err)
+		return
+	}
+	if c.Subprotocol() != wsSubprotocol {
+		_ = c.Close(websocket.StatusPolicyViolation, "unexpected subprotocol")
+		return
+	}
+	// The link outlives this HTTP request, so bind it to the core instead.
+	conn := &wsConn{
+		Conn:   websocket.NetConn(l.tcp.links.core.ctx, c, websocket.MessageBinary),
+		remote: l.remoteAddr(r),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	} else {
+		conn.local = l.listener.Addr()
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+// Works out the address of the remote side of a request, taking into account
+// any headers set by a trusted reverse proxy.
+func (l *wsListener) remoteAddr(r *http.Request) net.Addr {
+	if l.trustProxy {
+		forwarded := r.Header.Get("X-Real-IP")
+		if forwarded == "" {
+			// Proxies append to the list, so the last entry is the one that
+			// the proxy in front of us actually saw.
+			if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+				hops := strings.Split(xff[len(xff)-1], ",")
+				forwarded = strings.TrimSpace(hops[len(hops)-1])
+			}
+		}
+		if ip := net.ParseIP(forwarded); ip != nil {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return l.listener.Addr()
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.cancel()
+	return l.server.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Dials a WebSocket connection to the given ws:// or wss:// URL. The TCP
+// connection is made by us rather than by net/http so that we can find out the
+// real addresses in use, which will be those of the HTTP proxy if there is one.
+func (t *tcp) dialWS(ctx context.Context, saddr string, options *tcpOptions) (net.Conn, error) {
+	var local, remote net.Addr
+	dialer := net.Dialer{
+		Control:         t.tcpContext,
+		KeepAliveConfig: t.keepAliveConfig(),
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err == nil {
+				local, remote = conn.LocalAddr(), conn.RemoteAddr()
+			}
+			return conn, err
+		},
+		TLSHandshakeTimeout: default_timeout,
+	}
+	defer transport.CloseIdleConnections()
+	c, _, err := websocket.Dial(ctx, saddr, &websocket.DialOptions{
+		HTTPClient:   &http.Client{Transport: transport},
+		Subprotocols: []string{wsSubprotocol},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Subprotocol() != wsSubprotocol {
+		_ = c.Close(websocket.StatusPolicyViolation, "unexpected subprotocol")
+		return nil, errors.New("remote did not agree to the " + wsSubprotocol + " subprotocol")
+	}
+	if local == nil || remote == nil {
+		return nil, errors.New("failed to determine WebSocket connection addresses")
+	}
+	return &wsConn{
+		Conn:   websocket.NetConn(t.links.core.ctx, c, websocket.MessageBinary),
+		local:  local,
+		remote: remote,
+	}, nil
+}
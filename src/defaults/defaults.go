@@ -35,6 +35,13 @@ func GenerateConfig() *config.NodeConfig {
 	cfg.Peers = []string{}
 	cfg.InterfacePeers = map[string][]string{}
 	cfg.AllowedPublicKeys = []string{}
+	cfg.AllowedListenSources = []string{}
+	cfg.DeniedListenSources = []string{}
+	cfg.KeepAliveInterval = 4
+	cfg.ReadTimeout = 6
+	cfg.HandshakeTimeout = 10
+	cfg.MaxPendingHandshakes = 64
+	cfg.SourceConnectionsPerMinute = 30
 	cfg.MulticastInterfaces = GetDefaults().DefaultMulticastInterfaces
 	cfg.IfName = GetDefaults().DefaultIfName
 	cfg.IfMTU = GetDefaults().DefaultIfMTU